@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startAdminServer serves the metrics, health and readiness reports on the admin listener until Shutdown is
+// called on the returned server. It returns nil when no listener is configured.
+func startAdminServer(config AdminConfig) (*http.Server, error) {
+	if config.Listen == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w)
+	})
+	mux.HandleFunc("/health", serveReport(health))
+	mux.HandleFunc("/ready", serveReport(readiness))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Admin server stopped: %v\n", err)
+		}
+	}()
+	return server, nil
+}
+
+// serveReport answers with the JSON report of registry, with status 503 unless
+// every check is ok
+func serveReport(registry *healthRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, body := registry.report()
+		w.Header().Set("Content-Type", "application/json")
+		if status != healthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(body)
+	}
+}
+
+// stopAdminServer shuts the admin server down, if it was started
+func stopAdminServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
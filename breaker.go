@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+const (
+	defaultBreakerWindow   = 20
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+var (
+	breakerState = metrics.gauge("multiconsumer_circuit_breaker_state", "Circuit breaker state: 0 closed, 1 half-open, 2 open.", "breaker")
+	breakerOpens = metrics.counter("multiconsumer_circuit_breaker_opens_total", "Times a circuit breaker opened.", "breaker")
+)
+
+var breakerStateValues = map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}
+
+// circuitBreaker stops the consumers using it from handling messages while
+// handler calls keep failing. It opens after ConsecutiveFailures failures in a
+// row, or when more than FailureRate of the last Window calls failed. After the
+// cooldown it lets a single probe call through: the breaker closes if the probe
+// succeeds and opens again if it fails.
+type circuitBreaker struct {
+	name     string
+	config   CircuitBreakerConfig
+	window   int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	state       string
+	since       time.Time
+	consecutive int
+	outcomes    []bool    // latest calls, true for a failure
+	probeStart  time.Time // zero unless a probe call is under way
+	reason      string
+	changed     chan struct{} // closed on every state change
+}
+
+func newCircuitBreaker(name string, config CircuitBreakerConfig) *circuitBreaker {
+	b := &circuitBreaker{
+		name:     name,
+		config:   config,
+		window:   config.Window,
+		cooldown: time.Duration(config.Cooldown),
+		state:    breakerClosed,
+		since:    time.Now(),
+		changed:  make(chan struct{}),
+	}
+	if b.window <= 0 {
+		b.window = defaultBreakerWindow
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+	breakerState.Set(0, name)
+	health.register("circuit_breakers", name, b.health)
+	return b
+}
+
+// setState switches to state; b.mu must be held
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	b.since = time.Now()
+	b.probeStart = time.Time{}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	breakerState.Set(breakerStateValues[state], b.name)
+	if state == breakerOpen {
+		breakerOpens.Inc(b.name)
+	}
+}
+
+// wait blocks while the breaker is open and, when it is half-open, until the
+// caller may make the probe call. It returns false if ctx ends first.
+func (b *circuitBreaker) wait(ctx context.Context, logFunc func(level string, msg string, args ...interface{})) bool {
+	for {
+		b.mu.Lock()
+		var timer <-chan time.Time
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return true
+		case breakerOpen:
+			remaining := time.Until(b.since.Add(b.cooldown))
+			if remaining <= 0 {
+				b.setState(breakerHalfOpen)
+				logFunc("INFO", "Circuit breaker %s is half-open; probing with the next message", b.name)
+				b.mu.Unlock()
+				continue
+			}
+			timer = time.After(remaining)
+		case breakerHalfOpen:
+			// A probe that never reported back, e.g. because its consumer stopped, expires
+			remaining := time.Until(b.probeStart.Add(b.cooldown))
+			if b.probeStart.IsZero() || remaining <= 0 {
+				b.probeStart = time.Now()
+				b.mu.Unlock()
+				return true
+			}
+			timer = time.After(remaining)
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		case <-timer:
+		}
+	}
+}
+
+// record notes the outcome of a handler call and reports whether the breaker
+// is open or half-open afterwards
+func (b *circuitBreaker) record(failed bool, logFunc func(level string, msg string, args ...interface{})) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.setState(breakerOpen)
+			logFunc("WARNING", "Circuit breaker %s probe failed; pausing for %s", b.name, b.cooldown)
+		} else {
+			b.consecutive = 0
+			b.outcomes = nil
+			b.reason = ""
+			b.setState(breakerClosed)
+			logFunc("INFO", "Circuit breaker %s closed; resuming", b.name)
+		}
+	case breakerClosed:
+		if failed {
+			b.consecutive++
+		} else {
+			b.consecutive = 0
+		}
+		b.outcomes = append(b.outcomes, failed)
+		if len(b.outcomes) > b.window {
+			b.outcomes = b.outcomes[1:]
+		}
+		failures := 0
+		for _, outcome := range b.outcomes {
+			if outcome {
+				failures++
+			}
+		}
+		rate := float64(failures) / float64(len(b.outcomes))
+
+		switch {
+		case b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures:
+			b.reason = fmt.Sprintf("%d consecutive failures", b.consecutive)
+		case b.config.FailureRate > 0 && len(b.outcomes) >= b.window && rate > b.config.FailureRate:
+			b.reason = fmt.Sprintf("%d of the last %d calls failed", failures, len(b.outcomes))
+		default:
+			return false
+		}
+		b.setState(breakerOpen)
+		logFunc("WARNING", "Circuit breaker %s opened after %s; pausing for %s", b.name, b.reason, b.cooldown)
+	}
+	return b.state != breakerClosed
+}
+
+// health reports the breaker state for the admin /health endpoint
+func (b *circuitBreaker) health() healthStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := healthStatus{Status: healthOK, Details: map[string]interface{}{"state": b.state, "since": b.since.UTC().Format(time.RFC3339)}}
+	if b.state != breakerClosed {
+		status.Status = healthDegraded
+		status.Details["reason"] = b.reason
+	}
+	return status
+}
+
+// waitBreakers waits for every circuit breaker of the consumer to let a message through
+func (kc *KafkaConsumer) waitBreakers(ctx context.Context) bool {
+	for _, b := range kc.breakers {
+		if !b.wait(ctx, kc.logger) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordBreakers notes the outcome of a handler call in every circuit breaker
+// of the consumer and reports whether any of them is not closed
+func (kc *KafkaConsumer) recordBreakers(failed bool) bool {
+	tripped := false
+	for _, b := range kc.breakers {
+		if b.record(failed, kc.logger) {
+			tripped = true
+		}
+	}
+	return tripped
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   CircuitBreakerConfig
+		outcomes []bool // true for a failure
+		want     []string
+	}{
+		{
+			name:     "consecutive failures",
+			config:   CircuitBreakerConfig{ConsecutiveFailures: 3},
+			outcomes: []bool{true, true, true},
+			want:     []string{breakerClosed, breakerClosed, breakerOpen},
+		},
+		{
+			name:     "success resets consecutive failures",
+			config:   CircuitBreakerConfig{ConsecutiveFailures: 2},
+			outcomes: []bool{true, false, true, true},
+			want:     []string{breakerClosed, breakerClosed, breakerClosed, breakerOpen},
+		},
+		{
+			name:     "failure rate waits for a full window",
+			config:   CircuitBreakerConfig{FailureRate: 0.5, Window: 4},
+			outcomes: []bool{true, true, true, false},
+			want:     []string{breakerClosed, breakerClosed, breakerClosed, breakerOpen},
+		},
+		{
+			name:     "failure rate at the threshold stays closed",
+			config:   CircuitBreakerConfig{FailureRate: 0.5, Window: 4},
+			outcomes: []bool{true, false, true, false, false, true},
+			want:     []string{breakerClosed, breakerClosed, breakerClosed, breakerClosed, breakerClosed, breakerClosed},
+		},
+		{
+			name:     "failure rate over a sliding window",
+			config:   CircuitBreakerConfig{FailureRate: 0.5, Window: 2},
+			outcomes: []bool{false, true, true},
+			want:     []string{breakerClosed, breakerClosed, breakerOpen},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker("test-"+tt.name, tt.config)
+			for i, failed := range tt.outcomes {
+				tripped := b.record(failed, discardLog)
+				if b.state != tt.want[i] || tripped != (tt.want[i] != breakerClosed) {
+					t.Fatalf("after outcome %d: state = %s, tripped = %v, want %s", i, b.state, tripped, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		probeFailed bool
+		want        string
+	}{
+		{name: "probe succeeds", want: breakerClosed},
+		{name: "probe fails", probeFailed: true, want: breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker("test-"+tt.name, CircuitBreakerConfig{ConsecutiveFailures: 1, Cooldown: Duration(time.Hour)})
+			b.record(true, discardLog)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if b.wait(ctx, discardLog) {
+				t.Fatal("wait returned true while the breaker is open")
+			}
+
+			// Let the cooldown pass
+			b.since = b.since.Add(-2 * time.Hour)
+			if !b.wait(context.Background(), discardLog) {
+				t.Fatal("wait returned false after the cooldown")
+			}
+			if b.state != breakerHalfOpen {
+				t.Fatalf("state = %s, want %s", b.state, breakerHalfOpen)
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if b.wait(ctx, discardLog) {
+				t.Fatal("a second call got through while the probe is under way")
+			}
+
+			b.record(tt.probeFailed, discardLog)
+			if b.state != tt.want {
+				t.Errorf("state = %s, want %s", b.state, tt.want)
+			}
+			if tt.want == breakerClosed && (b.consecutive != 0 || len(b.outcomes) != 0) {
+				t.Errorf("closed breaker kept consecutive = %d, outcomes = %v", b.consecutive, b.outcomes)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// commands maps subcommand names to their implementation. Running the binary
+// without a subcommand starts the consumers.
+var commands = map[string]func(args []string) int{
+	"validate":      validateCommand,
+	"reset-offsets": resetOffsetsCommand,
+	"replay":        replayCommand,
+}
+
+// configFlags holds the flags shared by every command that loads the configuration
+type configFlags struct {
+	env     *string
+	configs stringList
+	sets    repeatedFlag
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	flags := &configFlags{
+		env: fs.String("env", "development", "Specify the environment defined in the config, e.g. production, staging, development"),
+	}
+	fs.Var(&flags.configs, "config", "Config file or directory, merged in order; repeat or separate with commas (default config.json)")
+	fs.Var(&flags.sets, "set", "Override a config field as path=value, e.g. kafkaConsumers.0.debug_mode=true; may be repeated")
+	return flags
+}
+
+// loadConfig reads the config files and applies the MULTICONSUMER_* environment variable
+// overrides, then the -set overrides
+func loadConfig(flags *configFlags) (*FullConfig, error) {
+	config, err := ReadConfig(flags.paths()...)
+	if err != nil {
+		return nil, err
+	}
+
+	sets, err := SetOverrides(flags.sets)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyOverrides(config, append(EnvOverrides(os.Environ()), sets...))
+}
+
+// paths returns the config paths given on the command line, or config.json
+func (f *configFlags) paths() []string {
+	if len(f.configs) == 0 {
+		return []string{"config.json"}
+	}
+	return f.configs
+}
+
+// stringList is a flag that may be repeated and also accepts comma-separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedFlag is a flag that may be repeated; values are kept as given
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string {
+	return fmt.Sprint([]string(*r))
+}
+
+func (r *repeatedFlag) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
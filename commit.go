@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Commit strategies; see KafkaConfig
+const (
+	commitSync     = "sync"
+	commitInterval = "interval"
+	commitManual   = "manual"
+)
+
+const defaultCommitInterval = time.Second
+
+var (
+	commitsTotal        = metrics.counter("multiconsumer_commits_total", "Offset commits sent to the group coordinator.", "consumer")
+	commitFailuresTotal = metrics.counter("multiconsumer_commit_failures_total", "Offset commits that failed.", "consumer")
+	committedOffset     = metrics.gauge("multiconsumer_committed_offset", "Latest offset committed per assigned partition.", "consumer", "topic", "partition")
+	uncommittedMessages = metrics.gauge("multiconsumer_uncommitted_messages", "Processed messages waiting for the next commit.", "consumer")
+)
+
+// commitStrategy returns the commit strategy. Without one, setting
+// commit_interval or commit_messages selects "interval".
+func (c KafkaConfig) commitStrategy() string {
+	switch {
+	case c.CommitStrategy != "":
+		return c.CommitStrategy
+	case c.CommitInterval > 0 || c.CommitMessages > 0:
+		return commitInterval
+	default:
+		return commitSync
+	}
+}
+
+// offsetCommitter commits offsets for a generation of the consumer group;
+// *kafka.Generation implements it
+type offsetCommitter interface {
+	CommitOffsets(offsets map[string]map[int]int64) error
+}
+
+// committer collects the offsets of processed messages of some partitions
+// during one generation of the consumer group and commits them as the strategy
+// requires. Offsets that fail to commit stay pending for the next attempt.
+type committer struct {
+	consumer string
+	strategy string
+	interval time.Duration
+	messages int
+	gen      offsetCommitter
+	logger   func(level string, msg string, args ...interface{})
+
+	mu       sync.Mutex
+	assigned map[string]map[int]bool
+	pending  map[string]map[int]int64
+	count    int
+}
+
+func newCommitter(config ConsumerConfig, gen offsetCommitter, partitions []TopicPartition, logger func(level string, msg string, args ...interface{})) *committer {
+	c := &committer{
+		consumer: config.Name,
+		strategy: config.commitStrategy(),
+		interval: time.Duration(config.CommitInterval),
+		messages: config.CommitMessages,
+		gen:      gen,
+		logger:   logger,
+		assigned: make(map[string]map[int]bool),
+		pending:  make(map[string]map[int]int64),
+	}
+	if c.interval <= 0 && c.messages == 0 {
+		c.interval = defaultCommitInterval
+	}
+	for _, partition := range partitions {
+		if c.assigned[partition.Topic] == nil {
+			c.assigned[partition.Topic] = make(map[int]bool)
+		}
+		c.assigned[partition.Topic][partition.Partition] = true
+	}
+	return c
+}
+
+// mark records messages as processed, so that the group resumes after them.
+// Messages of other partitions are ignored.
+func (c *committer) mark(messages ...kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	marked := 0
+	for _, message := range messages {
+		if !c.assigned[message.Topic][message.Partition] {
+			continue
+		}
+		if c.pending[message.Topic] == nil {
+			c.pending[message.Topic] = make(map[int]int64)
+		}
+		if next := message.Offset + 1; next > c.pending[message.Topic][message.Partition] {
+			c.pending[message.Topic][message.Partition] = next
+		}
+		marked++
+	}
+	c.count += marked
+	uncommittedMessages.Add(float64(marked), c.consumer)
+}
+
+// processed is called once the handler is done with a message. It marks the
+// message, unless handlers commit manually, and commits when the strategy
+// requires it.
+func (c *committer) processed(message kafka.Message) {
+	if c.strategy != commitManual {
+		c.mark(message)
+	}
+	c.mu.Lock()
+	due := c.strategy != commitInterval || (c.messages > 0 && c.count >= c.messages)
+	c.mu.Unlock()
+	if due {
+		c.flush()
+	}
+}
+
+// run commits every interval until the generation ends; it only does anything
+// for the interval strategy
+func (c *committer) run(ctx context.Context) {
+	if c.strategy != commitInterval || c.interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+// flush commits the pending offsets
+func (c *committer) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	commitsTotal.Inc(c.consumer)
+	if err := c.gen.CommitOffsets(c.pending); err != nil {
+		commitFailuresTotal.Inc(c.consumer)
+		c.logger("ERROR", "Failed to commit offsets: %v", err)
+		return err
+	}
+	for topic, partitions := range c.pending {
+		for partition, offset := range partitions {
+			committedOffset.Set(float64(offset), c.consumer, topic, strconv.Itoa(partition))
+		}
+	}
+	c.pending = make(map[string]map[int]int64)
+	uncommittedMessages.Add(-float64(c.count), c.consumer)
+	c.count = 0
+	return nil
+}
+
+// release drops the metrics of the committer's partitions once they are given up
+func (c *committer) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uncommittedMessages.Add(-float64(c.count), c.consumer)
+	c.count = 0
+	for topic, partitions := range c.assigned {
+		for partition := range partitions {
+			committedOffset.Delete(c.consumer, topic, strconv.Itoa(partition))
+		}
+	}
+}
+
+// Commit marks messages as processed for a consumer with the manual commit
+// strategy. They are committed once the current handler returns, and at the
+// latest when the partitions are revoked or the consumer stops. Messages of
+// partitions the consumer does not own are ignored.
+func (kc *KafkaConsumer) Commit(messages ...kafka.Message) {
+	kc.commitMu.Lock()
+	committers := kc.committers
+	kc.commitMu.Unlock()
+	for _, c := range committers {
+		c.mark(messages...)
+	}
+}
+
+func (kc *KafkaConsumer) setCommitters(committers []*committer) {
+	kc.commitMu.Lock()
+	defer kc.commitMu.Unlock()
+	kc.committers = committers
+}
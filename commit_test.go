@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func discardLog(level string, msg string, args ...interface{}) {}
+
+// fakeGeneration records the offsets committed through it
+type fakeGeneration struct {
+	mu      sync.Mutex
+	commits []map[string]map[int]int64
+	err     error
+}
+
+func (g *fakeGeneration) CommitOffsets(offsets map[string]map[int]int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return g.err
+	}
+	committed := make(map[string]map[int]int64)
+	for topic, partitions := range offsets {
+		committed[topic] = make(map[int]int64)
+		for partition, offset := range partitions {
+			committed[topic][partition] = offset
+		}
+	}
+	g.commits = append(g.commits, committed)
+	return nil
+}
+
+func (g *fakeGeneration) committed() []map[string]map[int]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.commits
+}
+
+func TestCommitterStrategies(t *testing.T) {
+	message := func(partition int, offset int64) kafka.Message {
+		return kafka.Message{Topic: "cities", Partition: partition, Offset: offset}
+	}
+	type step struct {
+		commit    bool // mark the message with Commit before it is processed
+		message   kafka.Message
+		processed bool
+	}
+
+	tests := []struct {
+		name   string
+		config KafkaConfig
+		steps  []step
+		want   []map[string]map[int]int64
+	}{
+		{
+			name:   "sync commits every message",
+			config: KafkaConfig{},
+			steps:  []step{{message: message(0, 4), processed: true}, {message: message(0, 5), processed: true}},
+			want:   []map[string]map[int]int64{{"cities": {0: 5}}, {"cities": {0: 6}}},
+		},
+		{
+			name:   "interval commits every commit_messages",
+			config: KafkaConfig{CommitMessages: 2},
+			steps: []step{
+				{message: message(0, 4), processed: true},
+				{message: message(1, 9), processed: true},
+				{message: message(0, 5), processed: true},
+			},
+			want: []map[string]map[int]int64{{"cities": {0: 5, 1: 10}}},
+		},
+		{
+			name:   "manual commits only marked messages",
+			config: KafkaConfig{CommitStrategy: commitManual},
+			steps: []step{
+				{message: message(0, 4), processed: true},
+				{commit: true, message: message(0, 5), processed: true},
+			},
+			want: []map[string]map[int]int64{{"cities": {0: 6}}},
+		},
+		{
+			name:   "unassigned partitions are ignored",
+			config: KafkaConfig{},
+			steps:  []step{{message: kafka.Message{Topic: "countries", Partition: 0, Offset: 3}, processed: true}},
+			want:   nil,
+		},
+		{
+			name:   "offsets never go back",
+			config: KafkaConfig{CommitStrategy: commitManual},
+			steps: []step{
+				{commit: true, message: message(0, 8)},
+				{commit: true, message: message(0, 5), processed: true},
+			},
+			want: []map[string]map[int]int64{{"cities": {0: 9}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &fakeGeneration{}
+			partitions := []TopicPartition{{Topic: "cities", Partition: 0}, {Topic: "cities", Partition: 1}}
+			c := newCommitter(ConsumerConfig{Name: "test", KafkaConfig: tt.config}, gen, partitions, discardLog)
+			for _, s := range tt.steps {
+				if s.commit {
+					c.mark(s.message)
+				}
+				if s.processed {
+					c.processed(s.message)
+				}
+			}
+			if got := gen.committed(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitterInterval(t *testing.T) {
+	gen := &fakeGeneration{}
+	config := ConsumerConfig{Name: "test", KafkaConfig: KafkaConfig{CommitInterval: Duration(10 * time.Millisecond)}}
+	c := newCommitter(config, gen, []TopicPartition{{Topic: "cities", Partition: 0}}, discardLog)
+
+	c.processed(kafka.Message{Topic: "cities", Partition: 0, Offset: 7})
+	if got := gen.committed(); len(got) != 0 {
+		t.Fatalf("committed before the interval: %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(gen.committed()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	want := []map[string]map[int]int64{{"cities": {0: 8}}}
+	if got := gen.committed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commits = %v, want %v", got, want)
+	}
+}
+
+func TestCommitterKeepsFailedOffsets(t *testing.T) {
+	gen := &fakeGeneration{err: errors.New("coordinator unavailable")}
+	c := newCommitter(ConsumerConfig{Name: "test"}, gen, []TopicPartition{{Topic: "cities", Partition: 0}}, discardLog)
+
+	c.processed(kafka.Message{Topic: "cities", Partition: 0, Offset: 3})
+	if err := c.flush(); err == nil {
+		t.Fatal("flush succeeded while the coordinator fails")
+	}
+
+	gen.mu.Lock()
+	gen.err = nil
+	gen.mu.Unlock()
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]map[int]int64{{"cities": {0: 4}}}
+	if got := gen.committed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commits = %v, want %v", got, want)
+	}
+}
@@ -2,21 +2,78 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
 	"github.com/segmentio/kafka-go"
 )
 // FullConfig represents the entire application configuration
 type FullConfig struct {
+    Environments   map[string]EnvironmentDef `json:"environments"`
     Redis          EnvConfig[RedisConfig]   `json:"redis"`
     Mongo          EnvConfig[MongoConfig]   `json:"mongo"`
     MySQL          EnvConfig[MySQLConfig]   `json:"mysql"`
+    Kafka          EnvConfig[KafkaConfig]   `json:"kafka"`
     KafkaConsumers []ConsumerConfig         `json:"kafkaConsumers"`
+    Producer       ProducerConfig           `json:"producer"`
+    Admin          AdminConfig              `json:"admin"`
+    Sinks          map[string]SinkConfig    `json:"sinks"`
+    Tracing        TracingConfig            `json:"tracing"`
+}
+
+// TracingConfig selects where the spans of consumed messages are exported:
+// "otlp" sends them to Endpoint over Protocol ("http/protobuf" by default, or
+// "grpc"), "stdout" prints them and "file" appends them to Path as JSON.
+// Tracing is off when Exporter is empty. SampleRatio (default 1) applies to
+// messages that do not carry a sampling decision from their publisher.
+type TracingConfig struct {
+    Exporter    string            `json:"exporter"`
+    Endpoint    string            `json:"endpoint"`
+    Protocol    string            `json:"protocol"`
+    Insecure    bool              `json:"insecure"`
+    Headers     map[string]string `json:"headers"`
+    Path        string            `json:"path"`
+    ServiceName string            `json:"service_name"`
+    SampleRatio *float64          `json:"sample_ratio"`
+}
+
+// SinkConfig represents a downstream system that several consumers write to,
+// such as a MySQL server. Its rate limits and circuit breaker are shared by
+// every consumer that lists the sink in its sinks.
+type SinkConfig struct {
+    MessagesPerSecond float64               `json:"messages_per_second"`
+    BytesPerSecond    float64               `json:"bytes_per_second"`
+    CircuitBreaker    *CircuitBreakerConfig `json:"circuit_breaker"`
+}
+
+// AdminConfig represents the HTTP listener that serves metrics and health, e.g. ":9100".
+// It is off when Listen is empty.
+type AdminConfig struct {
+    Listen string `json:"listen"`
+}
+
+// EnvironmentDef declares a named environment and the environment it inherits from
+type EnvironmentDef struct {
+    Extends string `json:"extends"`
 }
 
-// EnvConfig represents a generic configuration for multiple environments
-type EnvConfig[T any] struct {
-    Production  T `json:"production"`
-    Development T `json:"development"`
-    Staging     T `json:"staging"`
+// EnvConfig represents a generic configuration for multiple environments,
+// keyed by environment name. Entries are kept as raw JSON so that an
+// environment only has to list the fields it changes from its parent.
+type EnvConfig[T any] map[string]json.RawMessage
+
+// Environment holds every environment-scoped section resolved for one environment.
+// Field names match the EnvConfig fields of FullConfig; see GetEnvConfig.
+type Environment struct {
+    Name  string
+    Redis RedisConfig
+    Mongo MongoConfig
+    MySQL MySQLConfig
+    Kafka KafkaConfig
 }
 
 // RedisConfig represents Redis connection details
@@ -43,24 +100,396 @@ type MySQLConfig struct {
     Database string `json:"database"`
 }
 
+// KafkaConfig represents the Kafka connection and consumer tuning settings.
+// It is used both as the per-environment default and, embedded in
+// ConsumerConfig, as the per-consumer override; see ConsumerConfig.Resolve.
+// Tuning fields left at zero use the kafka-go defaults. IsolationLevel is
+// "read_uncommitted" (the default) or "read_committed"; GroupBalancers lists
+// "range", "round_robin" and "rack_affinity" in order of preference, the last
+// one using Rack as the consumer's rack. CommitStrategy is "sync" (the
+// default) to commit after every message, "interval" to commit every
+// CommitInterval or CommitMessages messages, whichever comes first, or
+// "manual" to commit only what handlers pass to HandlerDeps.Commit.
+type KafkaConfig struct {
+    Brokers       []string            `json:"brokers"`
+    GroupIDSuffix string              `json:"group_id_suffix"`
+    Security      KafkaSecurityConfig `json:"security"`
+    MinBytes      int                 `json:"min_bytes"`
+    MaxBytes      int                 `json:"max_bytes"`
+    MaxWait       Duration            `json:"max_wait"`
+    SessionTimeout    Duration        `json:"session_timeout"`
+    HeartbeatInterval Duration        `json:"heartbeat_interval"`
+    RebalanceTimeout  Duration        `json:"rebalance_timeout"`
+    CommitStrategy    string          `json:"commit_strategy"`
+    CommitInterval    Duration        `json:"commit_interval"`
+    CommitMessages    int             `json:"commit_messages"`
+    IsolationLevel    string          `json:"isolation_level"`
+    QueueCapacity     int             `json:"queue_capacity"`
+    GroupBalancers    []string        `json:"group_balancers"`
+    Rack              string          `json:"rack"`
+}
+
+// KafkaSecurityConfig represents the TLS and SASL settings used to reach the brokers
+type KafkaSecurityConfig struct {
+    TLS  TLSConfig  `json:"tls"`
+    SASL SASLConfig `json:"sasl"`
+}
+
+// TLSConfig represents the TLS settings for broker connections
+type TLSConfig struct {
+    Enabled            bool   `json:"enabled"`
+    CAFile             string `json:"ca_file"`
+    CertFile           string `json:"cert_file"`
+    KeyFile            string `json:"key_file"`
+    InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// SASLConfig represents the SASL credentials for broker connections.
+// Mechanism is one of "plain", "scram-sha-256" or "scram-sha-512".
+type SASLConfig struct {
+    Mechanism string `json:"mechanism"`
+    Username  string `json:"username"`
+    Password  string `json:"password"`
+}
+
+// ProducerConfig configures the shared producer that handlers publish with.
+// Defaults applies to every topic; Topics overrides it field by field per topic.
+type ProducerConfig struct {
+    Defaults TopicProducerConfig            `json:"defaults"`
+    Topics   map[string]TopicProducerConfig `json:"topics"`
+}
+
+// TopicProducerConfig represents the writer settings for one topic. Balancer is
+// one of "hash" (the default), "round_robin", "least_bytes", "crc32" or
+// "murmur2"; Acks is "all" (the default), "one" or "none"; Compression is
+// "none", "gzip", "snappy", "lz4" or "zstd".
+type TopicProducerConfig struct {
+    Balancer     string   `json:"balancer"`
+    Acks         string   `json:"acks"`
+    Compression  string   `json:"compression"`
+    BatchSize    int      `json:"batch_size"`
+    BatchBytes   int64    `json:"batch_bytes"`
+    BatchTimeout Duration `json:"batch_timeout"`
+}
+
 // ConsumerConfig represents the configuration for a Kafka consumer
 type ConsumerConfig struct {
-    Brokers    []string               `json:"brokers"`
+    Name       string                 `json:"name"`
+    Enabled    *bool                  `json:"enabled"`
+    KafkaConfig
     Topic      string                 `json:"topic"`
+    Topics     []string               `json:"topics"`
+    TopicPattern string               `json:"topic_pattern"`
+    TopicRefreshInterval Duration     `json:"topic_refresh_interval"`
     GroupID    string                 `json:"group_id"`
+    StartOffset StartOffset           `json:"start_offset"`
     LogFile    string                 `json:"log_file"`
     LogPrefix  string                 `json:"log_prefix"`
     DebugMode  bool                   `json:"debug_mode"`
     Settings   map[string]interface{} `json:"settings"` 
     HandlerName string                `json:"handler_name"` 
+    Forward    *ForwardConfig         `json:"forward"`
+    Dedup      *DedupConfig           `json:"dedup"`
+    Routes     []RouteConfig          `json:"routes"`
+    Handlers   []HandlerConfig        `json:"handlers"`
+    Execution  string                 `json:"execution"`
+    PartitionParallelism bool         `json:"partition_parallelism"`
+    RateLimit  *RateLimitConfig       `json:"rate_limit"`
+    CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+    Sinks      []string               `json:"sinks"`
+    HandlerTimeout   Duration         `json:"handler_timeout"`
+    HandlerWarnAfter Duration         `json:"handler_warn_after"`
+    MaxAbandonedHandlers int          `json:"max_abandoned_handlers"`
+    Retries    int                    `json:"retries"`
+    RetryBackoff Duration             `json:"retry_backoff"`
+    DeadLetterTopic string            `json:"dead_letter_topic"`
+    OnPanic    *PanicPolicyConfig     `json:"on_panic"`
+    Lag        *LagConfig             `json:"lag"`
+
+    // kafkaTree holds the Kafka settings present in the consumer's JSON, so
+    // that an explicit false, 0 or "" still overrides the environment
+    kafkaTree  map[string]interface{}
+}
+
+// LagConfig sets how often the lag of the consumer's assigned partitions is
+// measured (default 30s) and the thresholds at which it is reported: in
+// messages behind the high watermark, and in time behind head, the age of the
+// oldest message not committed yet. Zero thresholds are off.
+type LagConfig struct {
+    Interval         Duration `json:"interval"`
+    WarningMessages  int64    `json:"warning_messages"`
+    CriticalMessages int64    `json:"critical_messages"`
+    WarningTime      Duration `json:"warning_time"`
+    CriticalTime     Duration `json:"critical_time"`
+}
+
+// PanicPolicyConfig sets what happens once a consumer's handler panicked
+// MaxPanics times within Window (default 10m): Action "stop" (the default)
+// stops only that consumer, "exit" shuts the process down and exits with 1. Each panic on its own
+// is recovered and counts as a handler failure.
+type PanicPolicyConfig struct {
+    MaxPanics int      `json:"max_panics"`
+    Window    Duration `json:"window"`
+    Action    string   `json:"action"`
+}
+
+// RateLimitConfig limits how fast a consumer handles messages. Message and
+// byte rates are per second; the consumer's sinks add their shared limits.
+// MaxInFlight caps the messages handled at the same time, which matters with
+// partition_parallelism. Adaptive lowers MessagesPerSecond while the handler
+// is slow or failing.
+type RateLimitConfig struct {
+    MessagesPerSecond float64             `json:"messages_per_second"`
+    BytesPerSecond    float64             `json:"bytes_per_second"`
+    MaxInFlight       int                 `json:"max_in_flight"`
+    Adaptive          *AdaptiveRateConfig `json:"adaptive"`
+}
+
+// AdaptiveRateConfig sets when the adaptive rate limit slows down: when the
+// average handler latency exceeds TargetLatency or the share of failed
+// handler calls exceeds MaxErrorRate. The rate never drops below
+// MinMessagesPerSecond (default 1).
+type AdaptiveRateConfig struct {
+    TargetLatency        Duration `json:"target_latency"`
+    MaxErrorRate         float64  `json:"max_error_rate"`
+    MinMessagesPerSecond float64  `json:"min_messages_per_second"`
+}
+
+// CircuitBreakerConfig opens a circuit breaker after ConsecutiveFailures failed
+// handler calls in a row, or when more than FailureRate (0 to 1) of the last
+// Window calls failed (default 20). While open, the consumers behind it stop
+// handling messages for Cooldown (default 30s), then probe with one message.
+type CircuitBreakerConfig struct {
+    ConsecutiveFailures int      `json:"consecutive_failures"`
+    FailureRate         float64  `json:"failure_rate"`
+    Window              int      `json:"window"`
+    Cooldown            Duration `json:"cooldown"`
+}
+
+// HandlerConfig is one handler of a consumer's "handlers" list, which runs
+// every handler for each message, one after another or, with execution
+// "parallel", at the same time. OnFailure decides what a failure does:
+// "block" (the default) keeps the message uncommitted and retries the handler
+// until it succeeds, "retry" retries it Retries times (default 3) and then
+// logs it, and "log" only logs it. Retries wait RetryBackoff (default 1s),
+// doubled after each attempt.
+type HandlerConfig struct {
+    Name         string                 `json:"name"`
+    HandlerName  string                 `json:"handler_name"`
+    Settings     map[string]interface{} `json:"settings"`
+    OnFailure    string                 `json:"on_failure"`
+    Retries      *int                   `json:"retries"`
+    RetryBackoff Duration               `json:"retry_backoff"`
+}
+
+// RouteConfig sends the messages that match When to its own handler and
+// settings. The first matching route wins; a route without conditions is the
+// default route. With routes, the consumer's handler_name is optional and, when
+// set, acts as the default route.
+type RouteConfig struct {
+    Name        string                 `json:"name"`
+    When        RouteMatch             `json:"when"`
+    HandlerName string                 `json:"handler_name"`
+    Settings    map[string]interface{} `json:"settings"`
+}
+
+// RouteMatch lists the conditions of a route; a message must meet all of them.
+// Headers and Fields map a header name or a dotted JSON payload path to the
+// value it must have.
+type RouteMatch struct {
+    Headers map[string]string      `json:"headers"`
+    Key     string                 `json:"key"`
+    Fields  map[string]interface{} `json:"fields"`
+}
+
+// DedupConfig skips messages whose dedup key was already processed within TTL
+// (default 24h). Key is "key", "offset" or "value.<field path>"; Store is
+// "memory" (the default), "bbolt" with a file Path, or "redis", which uses the
+// environment's Redis settings.
+type DedupConfig struct {
+    Key   string   `json:"key"`
+    TTL   Duration `json:"ttl"`
+    Store string   `json:"store"`
+    Path  string   `json:"path"`
+}
+
+// ForwardConfig sends the output of a forwarding handler to another topic.
+// DedupWindow is how many of the latest messages per output partition are
+// scanned for already forwarded source offsets (default 1000).
+type ForwardConfig struct {
+    Topic       string `json:"topic"`
+    DedupWindow int    `json:"dedup_window"`
+}
+
+// IsEnabled reports whether the consumer should run; consumers are enabled unless set otherwise
+func (c ConsumerConfig) IsEnabled() bool {
+    return c.Enabled == nil || *c.Enabled
+}
+
+// kafkaConfigKeys are the JSON keys of the Kafka settings inlined in a consumer
+var kafkaConfigKeys = func() map[string]bool {
+    keys := make(map[string]bool)
+    t := reflect.TypeOf(KafkaConfig{})
+    for i := 0; i < t.NumField(); i++ {
+        keys[jsonName(t.Field(i))] = true
+    }
+    return keys
+}()
+
+// UnmarshalJSON decodes the consumer and keeps the Kafka settings it sets
+func (c *ConsumerConfig) UnmarshalJSON(data []byte) error {
+    type plain ConsumerConfig
+    if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+        return err
+    }
+    var tree map[string]interface{}
+    if err := json.Unmarshal(data, &tree); err != nil {
+        return err
+    }
+    c.kafkaTree = make(map[string]interface{})
+    for key, value := range tree {
+        if kafkaConfigKeys[key] {
+            c.kafkaTree[key] = value
+        }
+    }
+    return nil
+}
+
+// MarshalJSON writes the Kafka settings as the consumer set them and leaves out
+// the others, so that they are still inherited once the config is decoded again
+func (c ConsumerConfig) MarshalJSON() ([]byte, error) {
+    type plain ConsumerConfig
+    data, err := json.Marshal(plain(c))
+    if err != nil || c.kafkaTree == nil {
+        return data, err
+    }
+    var tree map[string]interface{}
+    if err := json.Unmarshal(data, &tree); err != nil {
+        return nil, err
+    }
+    for key := range kafkaConfigKeys {
+        if value, set := c.kafkaTree[key]; set {
+            tree[key] = value
+        } else {
+            delete(tree, key)
+        }
+    }
+    return json.Marshal(tree)
+}
+
+// Resolve layers the consumer's own Kafka settings on top of the environment
+// defaults and applies the group ID suffix. Settings the consumer leaves out
+// inherit the environment value; the ones it sets win, even false or 0. The
+// log prefix always includes the consumer name, after log_prefix when set.
+func (c ConsumerConfig) Resolve(env KafkaConfig) ConsumerConfig {
+    c.KafkaConfig = overlayKafka(env, c)
+    c.kafkaTree = nil
+    c.GroupID += c.GroupIDSuffix
+    if c.LogPrefix == "" || c.LogPrefix == c.Name {
+        c.LogPrefix = c.Name
+    } else {
+        c.LogPrefix += " " + c.Name
+    }
+    return c
+}
+
+// Duration is a time.Duration that reads from JSON either as a string such as
+// "500ms" or "1m30s", or as a plain number of milliseconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var v interface{}
+    if err := json.Unmarshal(data, &v); err != nil {
+        return err
+    }
+    switch value := v.(type) {
+    case float64:
+        *d = Duration(time.Duration(value) * time.Millisecond)
+    case string:
+        parsed, err := time.ParseDuration(value)
+        if err != nil {
+            return fmt.Errorf("invalid duration %q: %w", value, err)
+        }
+        *d = Duration(parsed)
+    default:
+        return fmt.Errorf("invalid duration %s", string(data))
+    }
+    return nil
+}
+
+// overlayKafka merges the Kafka settings set on a decoded consumer into env key
+// by key. Consumers built in code have no such record, so their non-zero
+// settings are used instead.
+func overlayKafka(env KafkaConfig, c ConsumerConfig) KafkaConfig {
+    if c.kafkaTree == nil {
+        return overlay(env, c.KafkaConfig)
+    }
+    data, err := json.Marshal(env)
+    if err != nil {
+        return overlay(env, c.KafkaConfig)
+    }
+    var tree interface{}
+    if err := json.Unmarshal(data, &tree); err != nil {
+        return overlay(env, c.KafkaConfig)
+    }
+    // The consumer's settings decoded once already, so they decode again
+    data, _ = json.Marshal(mergeTrees(tree, c.kafkaTree))
+    var result KafkaConfig
+    if err := json.Unmarshal(data, &result); err != nil {
+        return overlay(env, c.KafkaConfig)
+    }
+    return result
+}
+
+// overlay returns base with every non-zero field of override copied over it.
+// Nested structs are merged field by field; slices, maps and pointers replace
+// the base value when set.
+func overlay[T any](base, override T) T {
+    result := base
+    overlayValue(reflect.ValueOf(&result).Elem(), reflect.ValueOf(override))
+    return result
+}
+
+func overlayValue(dst, src reflect.Value) {
+    if dst.Kind() == reflect.Struct {
+        for i := 0; i < dst.NumField(); i++ {
+            if dst.Type().Field(i).IsExported() {
+                overlayValue(dst.Field(i), src.Field(i))
+            }
+        }
+        return
+    }
+    if !src.IsZero() {
+        dst.Set(src)
+    }
 }
 
 // KafkaConsumer represents a Kafka consumer with logging and consumption logic
 type KafkaConsumer struct {
-    reader         *kafka.Reader
+    dialer         *kafka.Dialer
+    client         *kafka.Client
+    producer       *Producer
     logger         func(level string, msg string, args ...interface{})
     ctx            context.Context
     cancel         context.CancelFunc
-    handleMessage  func(message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}))
+    handleMessage  func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error
+    hooks          partitionHooks
+    limiter        *consumerLimiter
+    breakers       []*circuitBreaker
+    lag            *lagMonitor
+    abandoned      *abandonedCalls
+    panicMu        sync.Mutex
+    panics         []time.Time
     consumerConfig ConsumerConfig 
+    topicPattern   *regexp.Regexp
+    topicsMu       sync.Mutex
+    topics         []string
+    fetchCancel    context.CancelFunc
+    done           chan struct{}
+    commitMu       sync.Mutex
+    committers     []*committer
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configExtensions lists the file formats a config file may be written in
+var configExtensions = map[string]func(data []byte, v interface{}) error{
+	".json": json.Unmarshal,
+	".yaml": yaml.Unmarshal,
+	".yml":  yaml.Unmarshal,
+	".toml": toml.Unmarshal,
+}
+
+// appendedConfigKeys are top-level lists that are concatenated, rather than
+// replaced, when several config files are merged. Entries with the same "name"
+// as an earlier entry are merged into it instead.
+var appendedConfigKeys = map[string]bool{
+	"kafkaConsumers": true,
+}
+
+// expandConfigPaths replaces every directory in paths with the config files it
+// contains, in lexical order
+func expandConfigPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config directory: %w", err)
+		}
+		var dirFiles []string
+		for _, entry := range entries {
+			if _, ok := configExtensions[strings.ToLower(filepath.Ext(entry.Name()))]; ok && !entry.IsDir() {
+				dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// readConfigTree decodes one config file into a generic JSON tree
+func readConfigTree(filename string) (map[string]interface{}, error) {
+	unmarshal, ok := configExtensions[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported config format", filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("%s: failed to unmarshal config data: %w", filename, err)
+	}
+
+	// Round-trip through JSON so YAML and TOML values take the same types as JSON ones
+	data, err = json.Marshal(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to encode config data: %w", filename, err)
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("%s: failed to unmarshal config data: %w", filename, err)
+	}
+	// Secret files are named relative to the config file that references them
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	anchorFileSecrets(tree, dir)
+	return tree, nil
+}
+
+// mergeConfigFiles merges the config trees in order. Later files override
+// earlier ones key by key, except for appendedConfigKeys, which are concatenated.
+func mergeConfigFiles(trees []map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, tree := range trees {
+		for key, value := range tree {
+			if appendedConfigKeys[key] {
+				existing, _ := merged[key].([]interface{})
+				if items, ok := value.([]interface{}); ok {
+					merged[key] = mergeNamedEntries(existing, items)
+					continue
+				}
+			}
+			merged[key] = mergeTrees(merged[key], value)
+		}
+	}
+	return merged
+}
+
+// mergeNamedEntries appends items to existing, merging each item that has the
+// same "name" as an existing entry into that entry
+func mergeNamedEntries(existing, items []interface{}) []interface{} {
+	for _, item := range items {
+		name := entryName(item)
+		merged := false
+		for i, entry := range existing {
+			if name != "" && entryName(entry) == name {
+				existing[i] = mergeTrees(entry, item)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			existing = append(existing, item)
+		}
+	}
+	return existing
+}
+
+func entryName(entry interface{}) string {
+	object, _ := entry.(map[string]interface{})
+	name, _ := object["name"].(string)
+	return name
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeConfigFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{
+			name:  "later files override key by key",
+			files: []string{`{"redis": {"development": {"host": "localhost", "port": 6379}}}`, `{"redis": {"development": {"port": 6380}}}`},
+			want:  `{"redis": {"development": {"host": "localhost", "port": 6380}}}`,
+		},
+		{
+			name:  "non-object values replace",
+			files: []string{`{"kafka": {"development": {"brokers": ["a:9092", "b:9092"]}}}`, `{"kafka": {"development": {"brokers": ["c:9092"]}}}`},
+			want:  `{"kafka": {"development": {"brokers": ["c:9092"]}}}`,
+		},
+		{
+			name:  "consumers are appended",
+			files: []string{`{"kafkaConsumers": [{"name": "cities"}]}`, `{"kafkaConsumers": [{"name": "countries"}]}`},
+			want:  `{"kafkaConsumers": [{"name": "cities"}, {"name": "countries"}]}`,
+		},
+		{
+			name:  "consumers with the same name are merged",
+			files: []string{`{"kafkaConsumers": [{"name": "cities", "topic": "cities", "debug_mode": false}]}`, `{"kafkaConsumers": [{"name": "cities", "debug_mode": true}]}`},
+			want:  `{"kafkaConsumers": [{"name": "cities", "topic": "cities", "debug_mode": true}]}`,
+		},
+		{
+			name:  "unnamed consumers are appended",
+			files: []string{`{"kafkaConsumers": [{"topic": "cities"}]}`, `{"kafkaConsumers": [{"topic": "cities"}]}`},
+			want:  `{"kafkaConsumers": [{"topic": "cities"}, {"topic": "cities"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trees []map[string]interface{}
+			for _, file := range tt.files {
+				var tree map[string]interface{}
+				if err := json.Unmarshal([]byte(file), &tree); err != nil {
+					t.Fatal(err)
+				}
+				trees = append(trees, tree)
+			}
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := mergeConfigFiles(trees); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergeConfigFiles() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConsumerConfigResolve(t *testing.T) {
+	env := KafkaConfig{
+		Brokers:       []string{"kafka-1:9092", "kafka-2:9092"},
+		GroupIDSuffix: "-prod",
+		MinBytes:      10,
+		Security: KafkaSecurityConfig{
+			TLS: TLSConfig{Enabled: true, CAFile: "ca.pem"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		consumer string
+		check    func(t *testing.T, resolved ConsumerConfig)
+	}{
+		{
+			name:     "inherits unset settings",
+			consumer: `{"name": "cities", "group_id": "cities"}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if !reflect.DeepEqual(resolved.Brokers, env.Brokers) || resolved.MinBytes != 10 || !resolved.Security.TLS.Enabled {
+					t.Errorf("resolved = %+v, want the environment settings", resolved.KafkaConfig)
+				}
+				if resolved.GroupID != "cities-prod" {
+					t.Errorf("GroupID = %q, want cities-prod", resolved.GroupID)
+				}
+			},
+		},
+		{
+			name:     "explicit zero wins",
+			consumer: `{"name": "cities", "min_bytes": 0}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if resolved.MinBytes != 0 {
+					t.Errorf("MinBytes = %d, want 0", resolved.MinBytes)
+				}
+			},
+		},
+		{
+			name:     "explicit false wins and nested settings merge",
+			consumer: `{"name": "cities", "security": {"tls": {"enabled": false}}}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if resolved.Security.TLS.Enabled {
+					t.Error("TLS.Enabled = true, want false")
+				}
+				if resolved.Security.TLS.CAFile != "ca.pem" {
+					t.Errorf("TLS.CAFile = %q, want ca.pem", resolved.Security.TLS.CAFile)
+				}
+			},
+		},
+		{
+			name:     "lists replace",
+			consumer: `{"name": "cities", "brokers": ["localhost:9092"]}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if !reflect.DeepEqual(resolved.Brokers, []string{"localhost:9092"}) {
+					t.Errorf("Brokers = %v, want [localhost:9092]", resolved.Brokers)
+				}
+			},
+		},
+		{
+			name:     "log prefix defaults to the name",
+			consumer: `{"name": "cities"}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if resolved.LogPrefix != "cities" {
+					t.Errorf("LogPrefix = %q, want cities", resolved.LogPrefix)
+				}
+			},
+		},
+		{
+			name:     "log prefix keeps the name",
+			consumer: `{"name": "cities", "log_prefix": "[geo]"}`,
+			check: func(t *testing.T, resolved ConsumerConfig) {
+				if resolved.LogPrefix != "[geo] cities" {
+					t.Errorf("LogPrefix = %q, want \"[geo] cities\"", resolved.LogPrefix)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var consumer ConsumerConfig
+			if err := json.Unmarshal([]byte(tt.consumer), &consumer); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, consumer.Resolve(env))
+		})
+	}
+}
+
+func TestConsumerConfigResolveInCode(t *testing.T) {
+	env := KafkaConfig{Brokers: []string{"kafka-1:9092"}, MinBytes: 10, MaxBytes: 1000}
+	consumer := ConsumerConfig{Name: "cities", KafkaConfig: KafkaConfig{MaxBytes: 500}}
+
+	resolved := consumer.Resolve(env)
+	if resolved.MinBytes != 10 || resolved.MaxBytes != 500 || len(resolved.Brokers) != 1 {
+		t.Errorf("resolved = %+v, want the non-zero consumer settings over the environment", resolved.KafkaConfig)
+	}
+}
+
+func TestConsumerConfigMarshalRoundTrip(t *testing.T) {
+	var consumer ConsumerConfig
+	if err := json.Unmarshal([]byte(`{"name": "cities", "min_bytes": 0, "security": {"tls": {"enabled": false}}}`), &consumer); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ConsumerConfig
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := decoded.Resolve(KafkaConfig{MinBytes: 10, MaxBytes: 1000, Security: KafkaSecurityConfig{TLS: TLSConfig{Enabled: true}}})
+	if resolved.MinBytes != 0 || resolved.Security.TLS.Enabled || resolved.MaxBytes != 1000 {
+		t.Errorf("resolved = %+v, want min_bytes 0, TLS disabled and max_bytes inherited", resolved.KafkaConfig)
+	}
+}
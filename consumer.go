@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"syscall"
 	"time"
 	"strings"
@@ -16,11 +17,42 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
-// ReadConfig reads the full configuration from a JSON file
-func ReadConfig(filename string) (*FullConfig, error) {
-	data, err := ioutil.ReadFile(filename)
+// ReadConfig reads the full configuration from one or more files or
+// directories, merged in order; see mergeConfigFiles. JSON, YAML and TOML files
+// are accepted. Secret references such as ${env:NAME} or ${file:/path} are
+// resolved here, except inside the environment-scoped sections, which
+// GetEnvConfig resolves for the selected environment only.
+func ReadConfig(paths ...string) (*FullConfig, error) {
+	files, err := expandConfigPaths(paths)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files found in %s", strings.Join(paths, ", "))
+	}
+
+	var trees []map[string]interface{}
+	for _, file := range files {
+		fileTree, err := readConfigTree(file)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, fileTree)
+	}
+	var tree interface{} = mergeConfigFiles(trees)
+
+	skip := make(map[string]bool)
+	for _, named := range (FullConfig{}).envSections() {
+		skip[named.key] = true
+	}
+	tree, err = resolveSecrets(tree, "", skip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets: %w", err)
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config data: %w", err)
 	}
 
 	var config FullConfig
@@ -45,25 +77,58 @@ func customLogger(prefix string, file *os.File, enableDebug bool) func(level str
             return // Do not log DEBUG messages unless debug mode is on
         }
         
-        logger.Printf(fmt.Sprintf("%s: %s", level, msg), args...)
+        logger.Print(redactSecrets(fmt.Sprintf(fmt.Sprintf("%s: %s", level, msg), args...)))
+    }
+}
+
+// createConsumerGroup creates the consumer group membership for the given topics
+func createConsumerGroup(config ConsumerConfig, topics []string, dialer *kafka.Dialer, logger func(level string, msg string, args ...interface{})) (*kafka.ConsumerGroup, error) {
+    groupConfig := kafka.ConsumerGroupConfig{
+        ID:                config.GroupID,
+        Brokers:           config.Brokers,
+        Dialer:            dialer,
+        Topics:            topics,
+        StartOffset:       config.StartOffset.readerStartOffset(),
+        SessionTimeout:    time.Duration(config.SessionTimeout),
+        HeartbeatInterval: time.Duration(config.HeartbeatInterval),
+        RebalanceTimeout:  time.Duration(config.RebalanceTimeout),
+        Logger:            kafka.LoggerFunc(func(msg string, args ...interface{}) { logger("DEBUG", msg, args...) }),
+    }
+    for _, name := range config.GroupBalancers {
+        groupConfig.GroupBalancers = append(groupConfig.GroupBalancers, groupBalancers[name](config.Rack))
     }
+    return kafka.NewConsumerGroup(groupConfig)
 }
 
-func createConsumer(brokers []string, topic, groupID string, logger func(level string, msg string, args ...interface{})) *kafka.Reader {
+// createPartitionReader creates the reader for one partition assigned to the consumer
+func createPartitionReader(config ConsumerConfig, topic string, partition int, dialer *kafka.Dialer, logger func(level string, msg string, args ...interface{})) *kafka.Reader {
     readerConfig := kafka.ReaderConfig{
-        Brokers:     brokers,
+        Brokers:     config.Brokers,
         Topic:       topic,
-        GroupID:     groupID,
+        Partition:   partition,
+        Dialer:      dialer,
         MinBytes:    1,
         MaxBytes:    10e6,
         MaxWait:     500 * time.Millisecond,
         Logger:      kafka.LoggerFunc(func(msg string, args ...interface{}) { logger("DEBUG", msg, args...) }),
     }
+    if config.MinBytes > 0 {
+        readerConfig.MinBytes = config.MinBytes
+    }
+    if config.MaxBytes > 0 {
+        readerConfig.MaxBytes = config.MaxBytes
+    }
+    if config.MaxWait > 0 {
+        readerConfig.MaxWait = time.Duration(config.MaxWait)
+    }
+    readerConfig.IsolationLevel = isolationLevels[config.IsolationLevel]
+    readerConfig.QueueCapacity = config.QueueCapacity
     return kafka.NewReader(readerConfig)
 }
 
-// NewKafkaConsumer creates a new KafkaConsumer with the given configuration and handler function
-func NewKafkaConsumer(config ConsumerConfig, handler func(message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}))) *KafkaConsumer {
+// NewKafkaConsumer creates a new KafkaConsumer with the given configuration, handler function,
+// the partition hooks of its handlers and the shared sinks
+func NewKafkaConsumer(config ConsumerConfig, handler func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error, hooks partitionHooks, sinks map[string]*sink, producer *Producer) *KafkaConsumer {
     ctx, cancel := context.WithCancel(context.Background())
 
     logFile, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
@@ -73,13 +138,50 @@ func NewKafkaConsumer(config ConsumerConfig, handler func(message kafka.Message,
 
     unifiedLogger := customLogger(config.LogPrefix, logFile, config.DebugMode)
 
+    dialer, err := newDialer(config.KafkaConfig)
+    if err != nil {
+        log.Fatalf("Failed to configure Kafka connection for %s: %v\n", config.LogPrefix, err)
+    }
+    client, err := newClient(config.KafkaConfig)
+    if err != nil {
+        log.Fatalf("Failed to configure Kafka connection for %s: %v\n", config.LogPrefix, err)
+    }
+
+    var topicPattern *regexp.Regexp
+    if config.TopicPattern != "" {
+        topicPattern, err = compileTopicPattern(config.TopicPattern)
+        if err != nil {
+            log.Fatalf("Invalid topic pattern for %s: %v\n", config.LogPrefix, err)
+        }
+    }
+
+    var breakers []*circuitBreaker
+    if config.CircuitBreaker != nil {
+        breakers = append(breakers, newCircuitBreaker("consumer/"+config.Name, *config.CircuitBreaker))
+    }
+    for _, name := range config.Sinks {
+        if s := sinks[name]; s != nil && s.breaker != nil {
+            breakers = append(breakers, s.breaker)
+        }
+    }
+
     consumer := &KafkaConsumer{
-        reader:         createConsumer(config.Brokers, config.Topic, config.GroupID, unifiedLogger),
+        dialer:         dialer,
+        client:         client,
+        producer:       producer,
+        topicPattern:   topicPattern,
+        topics:         resolveTopics(config, nil, nil),
         logger:         unifiedLogger,
         ctx:            ctx,
         cancel:         cancel,
         handleMessage:  handler,
+        hooks:          hooks,
+        limiter:        newConsumerLimiter(config, sinks, unifiedLogger),
+        breakers:       breakers,
+        lag:            newLagMonitor(config, client, dialer, unifiedLogger),
+        abandoned:      newAbandonedCalls(config),
         consumerConfig: config, // Assign the configuration here
+        done:           make(chan struct{}),
     }
     return consumer
 }
@@ -88,108 +190,260 @@ func NewKafkaConsumer(config ConsumerConfig, handler func(message kafka.Message,
 func (kc *KafkaConsumer) Start() {
     kc.logger("INFO", "Starting Kafka consumer...")
 
+    if kc.topicPattern != nil {
+        go kc.watchTopics(kc.topicPattern)
+    }
+    go kc.lag.run(kc.ctx)
+
     go func() {
-        var wasDisconnected bool
+        defer close(kc.done)
         for {
-            select {
-            case <-kc.ctx.Done():
+            // A change of topics cancels fetchCtx, and the group is joined again
+            topics, fetchCtx := kc.subscription()
+            if kc.ctx.Err() != nil {
                 kc.logger("WARNING", "Consumer shutdown signal received. Stopping...")
                 return
-            default:
-                message, err := kc.reader.FetchMessage(kc.ctx)
-                if err != nil {
-                    if !wasDisconnected {
-                        kc.logger("ERROR", "Lost connection to Kafka. Shutting down consumer and retrying in 5 seconds...")
-                        wasDisconnected = true
-                        kc.reader.Close()
-                    }
-                    time.Sleep(5 * time.Second)
-                    kc.reader = createConsumer(kc.consumerConfig.Brokers, kc.consumerConfig.Topic, kc.consumerConfig.GroupID, kc.logger)
-                    kc.logger("INFO", "Attempting to reconnect to Kafka...")
-                    continue
-                }
-
-                if wasDisconnected {
-                    kc.logger("INFO", "Reconnected to Kafka successfully. Consumer is ready.")
-                    wasDisconnected = false
-                }
-
-                // Call the custom handler function with the message and logger
-                kc.handleMessage(message, kc.consumerConfig, kc.logger)
+            }
+            if len(topics) == 0 {
+                kc.logger("WARNING", "No topics match the subscription yet. Waiting for topic discovery...")
+                <-fetchCtx.Done()
+                continue
+            }
 
-                if err := kc.reader.CommitMessages(kc.ctx, message); err != nil {
-                    kc.logger("ERROR", "Failed to commit message: %v\n", err)
+            kc.logger("INFO", "Subscribing to topics %s", describeTopics(topics))
+            if err := kc.applyStartOffset(topics); err != nil {
+                kc.logger("WARNING", "Failed to apply start_offset: %v", err)
+            }
+            if err := kc.consumeGroup(fetchCtx, topics); err != nil {
+                kc.logger("ERROR", "Failed to join consumer group %s, retrying in 5 seconds: %v", kc.consumerConfig.GroupID, err)
+                select {
+                case <-kc.ctx.Done():
+                case <-time.After(5 * time.Second):
                 }
             }
         }
     }()
 }
 
+// process runs the handler for a message within the message's span. A failure
+// that blocks the commit is retried until it succeeds. Other failures, including
+// timeouts and panics, are retried up to the consumer's retries and then sent
+// to its dead_letter_topic, or logged, before the message is committed. process
+// returns false if ctx ends first.
+func (kc *KafkaConsumer) process(ctx context.Context, message kafka.Message) bool {
+    ctx, span := kc.startMessageSpan(ctx, message)
+    var err error
+    attempts := 0
+    defer func() { endMessageSpan(span, attempts, err) }()
+
+    backoff := defaultRetryBackoff
+    if kc.consumerConfig.RetryBackoff > 0 {
+        backoff = time.Duration(kc.consumerConfig.RetryBackoff)
+    }
+    retries := 0
+    for {
+        if !kc.waitBreakers(ctx) || !kc.abandoned.wait(ctx, kc.logger) {
+            return false
+        }
+        start := time.Now()
+        attempts++
+        err = kc.callHandler(ctx, message)
+        if errors.Is(err, ErrHandlerPanic) && kc.recordPanic() {
+            return false // The consumer is stopping; leave the message uncommitted
+        }
+        failed := err != nil && !errors.Is(err, ErrSkipMessage)
+        kc.limiter.observe(time.Since(start), failed)
+        open := kc.recordBreakers(failed)
+        switch {
+        case errors.Is(err, ErrSkipMessage):
+            kc.logger("DEBUG", "Handler skipped message %s", describeMessage(message))
+            return true
+        case errors.Is(err, ErrCommitBlocked):
+            kc.logger("ERROR", "Handler failed for message %s, retrying in %s before committing: %v", describeMessage(message), backoff, err)
+            span.RecordError(err)
+        case err != nil && open:
+            // Hold the message uncommitted and try it again once the breaker lets it through
+            kc.logger("ERROR", "Handler failed for message %s, circuit breaker open, retrying it after the cooldown: %v", describeMessage(message), err)
+            span.RecordError(err)
+            continue
+        case err != nil && retries < kc.consumerConfig.Retries:
+            retries++
+            kc.logger("ERROR", "Handler failed for message %s, retry %d of %d in %s: %v", describeMessage(message), retries, kc.consumerConfig.Retries, backoff, err)
+            span.RecordError(err)
+        case err != nil && kc.consumerConfig.DeadLetterTopic != "":
+            kc.logger("ERROR", "Handler failed for message %s after %d attempt(s), sending it to %s: %v", describeMessage(message), attempts, kc.consumerConfig.DeadLetterTopic, err)
+            return kc.deadLetter(ctx, message, err)
+        case err != nil:
+            kc.logger("ERROR", "Handler failed for message %s after %d attempt(s): %v", describeMessage(message), attempts, err)
+            return true
+        default:
+            return true
+        }
+
+        select {
+        case <-ctx.Done():
+            return false
+        case <-time.After(backoff):
+        }
+        backoff = min(2*backoff, maxRetryBackoff)
+    }
+}
+
 // Stop stops the Kafka consumer gracefully
 func (kc *KafkaConsumer) Stop() {
     // Cancel the context to signal the consumer to stop
     kc.cancel()
-    // Close the Kafka reader and handle any potential error
-    if err := kc.reader.Close(); err != nil {
-        kc.logger("ERROR", "Error closing reader: %v\n", err)
-    }
+    // Wait for the current message and the final commit before leaving the group
+    <-kc.done
+    closeClient(kc.client)
     kc.logger("INFO", "Kafka consumer has been stopped.")
 }
 
-func GetEnvConfig(env string, config FullConfig) (RedisConfig, MongoConfig, MySQLConfig) {
-    switch env {
-    case "production":
-        return config.Redis.Production, config.Mongo.Production, config.MySQL.Production
-    case "staging":
-        return config.Redis.Staging, config.Mongo.Staging, config.MySQL.Staging
-    case "development":
-        return config.Redis.Development, config.Mongo.Development, config.MySQL.Development
-    default:
-        log.Fatalf("Unknown environment: %s", env)
-        return RedisConfig{}, MongoConfig{}, MySQLConfig{} // Unreachable, but required by Go
+// selectConsumers returns the enabled consumers, narrowed to the names in only
+// (when given) and without the names in exclude
+func selectConsumers(consumers []ConsumerConfig, only, exclude []string) ([]ConsumerConfig, error) {
+    known := make(map[string]bool)
+    for _, consumer := range consumers {
+        known[consumer.Name] = true
+    }
+    for _, name := range append(append([]string{}, only...), exclude...) {
+        if !known[name] {
+            return nil, fmt.Errorf("unknown consumer: %s", name)
+        }
+    }
+
+    contains := func(names []string, name string) bool {
+        for _, n := range names {
+            if n == name {
+                return true
+            }
+        }
+        return false
     }
+
+    var selected []ConsumerConfig
+    for _, consumer := range consumers {
+        if !consumer.IsEnabled() || contains(exclude, consumer.Name) {
+            continue
+        }
+        if len(only) > 0 && !contains(only, consumer.Name) {
+            continue
+        }
+        selected = append(selected, consumer)
+    }
+    if len(selected) == 0 {
+        return nil, fmt.Errorf("no enabled consumers selected")
+    }
+    return selected, nil
 }
 
-// Command-Line Flag: Use '-env production', -env staging, or -env development to specify
+// Command-Line Flag: Use '-env <name>' with any environment defined in the config, e.g. -env production
+// Use '-only a,b' or '-exclude c' to run a subset of the consumers by name
+// Subcommands: 'validate' checks the configuration without starting consumers,
+// 'reset-offsets' moves the committed offsets of a consumer group, 'replay'
+// reprocesses an offset or time range through a consumer's handler
 func main() {
+    if len(os.Args) > 1 {
+        if command, ok := commands[os.Args[1]]; ok {
+            os.Exit(command(os.Args[2:]))
+        }
+    }
+
     // Parse environment from command-line flag or default to "development"
-    env := flag.String("env", "development", "Specify the environment: production, staging, development")
+    flags := addConfigFlags(flag.CommandLine)
+    var only, exclude stringList
+    flag.Var(&only, "only", "Run only the named consumers (comma-separated or repeated)")
+    flag.Var(&exclude, "exclude", "Do not run the named consumers (comma-separated or repeated)")
     flag.Parse()
+    env := flags.env
 
-    config, err := ReadConfig("config.json")
+    config, err := loadConfig(flags)
     if err != nil {
         log.Fatalf("Failed to load configuration: %v\n", err)
     }
 
-    // Get the environment-specific configurations
-    redisConfig, mongoConfig, mysqlConfig := GetEnvConfig(*env, *config) 
+    // Report every configuration problem before starting any consumer
+    if errs := ValidateConfig(config, *env); len(errs) > 0 {
+        log.Fatalf("Configuration has %d problem(s) for environment %s:\n%v\n", len(errs), *env, errs)
+    }
 
-    // Map handler names to functions
-    handlers := map[string]func(kafka.Message, ConsumerConfig, func(level string, msg string, args ...interface{}), RedisConfig, MongoConfig, MySQLConfig) {
-        "handler1": handler1,
-        "handler2": handler2,
+    // Get the environment-specific configurations
+    environment, err := GetEnvConfig(*env, *config)
+    if err != nil {
+        log.Fatalf("Failed to resolve environment: %v\n", err)
     }
+    redisConfig, mongoConfig, mysqlConfig, kafkaConfig := environment.Redis, environment.Mongo, environment.MySQL, environment.Kafka
 
-    // Print configurations for verification
-    fmt.Printf("Using environment: %s\n", *env)
-    fmt.Printf("Redis Config: Host=%s, Port=%d\n", redisConfig.Host, redisConfig.Port)
-    fmt.Printf("Mongo Config: Server=%s, Port=%d, User=%s, Database=%s\n",
+    // Print configurations for verification, masking any resolved secrets
+    printf := func(format string, args ...interface{}) {
+        fmt.Print(redactSecrets(fmt.Sprintf(format, args...)))
+    }
+    printf("Using environment: %s\n", *env)
+    printf("Redis Config: Host=%s, Port=%d\n", redisConfig.Host, redisConfig.Port)
+    printf("Mongo Config: Server=%s, Port=%d, User=%s, Database=%s\n",
         mongoConfig.Server, mongoConfig.Port, mongoConfig.Username, mongoConfig.Database)
-    fmt.Printf("MySQL Config: Host=%s, Port=%d, User=%s, Database=%s\n",
+    printf("MySQL Config: Host=%s, Port=%d, User=%s, Database=%s\n",
         mysqlConfig.Host, mysqlConfig.Port, mysqlConfig.User, mysqlConfig.Database)
+    printf("Kafka Config: Brokers=%s, GroupIDSuffix=%s\n",
+        strings.Join(kafkaConfig.Brokers, ","), kafkaConfig.GroupIDSuffix)
+
+    // Handlers publish derived messages through one shared producer
+    producer, err := NewProducer(config.Producer, kafkaConfig)
+    if err != nil {
+        log.Fatalf("Failed to configure producer: %v\n", err)
+    }
+    deps := HandlerDeps{Redis: redisConfig, Mongo: mongoConfig, MySQL: mysqlConfig, Producer: producer}
+
+    // Consumers writing to the same sink share its rate limits and circuit breaker
+    sinks := newSinks(config.Sinks)
+
+    admin, err := startAdminServer(config.Admin)
+    if err != nil {
+        log.Fatalf("Failed to start admin server: %v\n", err)
+    }
+
+    shutdownTracing, err := startTracing(config.Tracing)
+    if err != nil {
+        log.Fatalf("Failed to set up tracing: %v\n", err)
+    }
 
 	// Create consumers based on the loaded configuration and specified handler from the config
     var consumers []*KafkaConsumer
-    for _, consumerConfig := range config.KafkaConsumers {
-        handlerFunc, exists := handlers[consumerConfig.HandlerName]
-        if !exists {
-            log.Fatalf("Handler %s not found\n", consumerConfig.HandlerName)
+    var closers []func() error
+    selected, err := selectConsumers(config.KafkaConsumers, only, exclude)
+    if err != nil {
+        log.Fatalf("Failed to select consumers: %v\n", err)
+    }
+    for _, consumerConfig := range selected {
+        // Layer the consumer's own Kafka settings over the environment defaults
+        consumerConfig = consumerConfig.Resolve(kafkaConfig)
+
+        // Handlers of a consumer with the manual commit strategy commit through it
+        var consumer *KafkaConsumer
+        consumerDeps := deps
+        if consumerConfig.commitStrategy() == commitManual {
+            consumerDeps.Commit = func(messages ...kafka.Message) { consumer.Commit(messages...) }
         }
 
-        consumer := NewKafkaConsumer(consumerConfig, func(message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) {
-            handlerFunc(message, config, logFunc, redisConfig, mongoConfig, mysqlConfig)
-        })
+        handle, closeHandler, err := newMessageHandler(consumerConfig, consumerDeps, true)
+        if err != nil {
+            log.Fatalf("Failed to set up handler for %s: %v\n", consumerConfig.Name, err)
+        }
+        closers = append(closers, closeHandler)
+        if consumerConfig.Dedup != nil {
+            store, err := newDedupStore(*consumerConfig.Dedup, redisConfig)
+            if err != nil {
+                log.Fatalf("Failed to set up dedup store for %s: %v\n", consumerConfig.Name, err)
+            }
+            closers = append(closers, store.Close)
+            handle = withDedup(consumerConfig, store, handle)
+        }
+
+        consumer = NewKafkaConsumer(consumerConfig, handle, newPartitionHooks(consumerConfig, consumerDeps), sinks, producer)
         consumers = append(consumers, consumer)
+        printf("Starting consumer %s: Topics=%s, TopicPattern=%s, GroupID=%s, Handler=%s\n",
+            consumerConfig.Name, strings.Join(consumerConfig.StaticTopics(), ","), consumerConfig.TopicPattern,
+            consumerConfig.GroupID, consumerConfig.HandlerName)
         consumer.Start()
     }
 
@@ -197,9 +451,34 @@ func main() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	<-signalChan
+	// A consumer's on_panic exit policy shuts down the same way, then exits with an error
+	exitReason := ""
+	select {
+	case <-signalChan:
+	case exitReason = <-exitRequests:
+		log.Printf("Shutting down: %s\n", exitReason)
+	}
 	for _, consumer := range consumers {
-		consumer.logger("INFO", "Received termination signal. Shutting down...")
+		if exitReason == "" {
+			consumer.logger("INFO", "Received termination signal. Shutting down...")
+		} else {
+			consumer.logger("INFO", "Shutting down: %s", exitReason)
+		}
 		consumer.Stop()
 	}
+	for _, closeHandler := range closers {
+		if err := closeHandler(); err != nil {
+			log.Printf("Failed to close handler: %v\n", err)
+		}
+	}
+	if err := producer.Close(); err != nil {
+		log.Printf("Failed to flush producer: %v\n", err)
+	}
+	if err := stopTracing(shutdownTracing); err != nil {
+		log.Printf("Failed to flush traces: %v\n", err)
+	}
+	stopAdminServer(admin)
+	if exitReason != "" {
+		os.Exit(1)
+	}
 }
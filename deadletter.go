@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errorHeader carries the handler error on a dead-lettered message, next to
+// the source headers of forwarded messages
+const errorHeader = "mc-error"
+
+var deadLetteredTotal = metrics.counter("multiconsumer_dead_lettered_total", "Messages sent to the dead letter topic after their retries failed.", "consumer")
+
+// deadLetter writes a message whose handler kept failing to the consumer's
+// dead_letter_topic, with its source and the last error in the headers. The
+// write is retried until it succeeds, so the message is only committed once it
+// is safe in the topic; it reports false when ctx ends first.
+func (kc *KafkaConsumer) deadLetter(ctx context.Context, message kafka.Message, cause error) bool {
+	topic := kc.consumerConfig.DeadLetterTopic
+	var headers []kafka.Header
+	for _, header := range withoutSourceHeaders(message.Headers) {
+		if header.Key != errorHeader {
+			headers = append(headers, header)
+		}
+	}
+	dead := kafka.Message{
+		Topic: topic,
+		Key:   message.Key,
+		Value: message.Value,
+		Headers: append(headers,
+			kafka.Header{Key: sourceTopicHeader, Value: []byte(message.Topic)},
+			kafka.Header{Key: sourcePartitionHeader, Value: []byte(strconv.Itoa(message.Partition))},
+			kafka.Header{Key: sourceOffsetHeader, Value: []byte(strconv.FormatInt(message.Offset, 10))},
+			kafka.Header{Key: errorHeader, Value: []byte(cause.Error())},
+		),
+	}
+
+	backoff := defaultRetryBackoff
+	for {
+		err := kc.producer.Produce(ctx, dead)
+		if err == nil {
+			deadLetteredTotal.Inc(kc.consumerConfig.Name)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("multiconsumer.dead_letter_topic", topic))
+			kc.logger("WARNING", "Sent message %s to dead letter topic %s", describeMessage(message), topic)
+			return true
+		}
+		kc.logger("ERROR", "Failed to send message %s to dead letter topic %s, retrying in %s: %v", describeMessage(message), topic, backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
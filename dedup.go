@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultDedupTTL = 24 * time.Hour
+
+	// dedupPurgeInterval is how often the memory and bbolt stores drop expired keys
+	dedupPurgeInterval = time.Minute
+)
+
+// DedupStore remembers the keys of processed messages for a limited time
+type DedupStore interface {
+	Seen(ctx context.Context, key string) (bool, error)
+	Mark(ctx context.Context, key string, ttl time.Duration) error
+	Close() error
+}
+
+// newDedupStore opens the store selected in the consumer's dedup settings
+func newDedupStore(config DedupConfig, redisConfig RedisConfig) (DedupStore, error) {
+	switch config.Store {
+	case "", "memory":
+		return &memoryDedupStore{expires: make(map[string]time.Time)}, nil
+	case "bbolt":
+		return openBoltDedupStore(config.Path)
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(redisConfig.Host, strconv.Itoa(redisConfig.Port))})
+		return &redisDedupStore{client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown dedup store %q", config.Store)
+	}
+}
+
+// withDedup wraps a message handler so that messages whose dedup key was
+// already processed are skipped before the handler runs. A key is recorded only
+// after the handler succeeded. When the store fails the message is processed,
+// as delivery is at least once either way.
+func withDedup(config ConsumerConfig, store DedupStore, handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error) func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+	ttl := time.Duration(config.Dedup.TTL)
+	if ttl == 0 {
+		ttl = defaultDedupTTL
+	}
+
+	return func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+		key, ok := dedupKey(config.Dedup.Key, message)
+		if !ok {
+			logFunc("DEBUG", "Message %s has no dedup key %s; processing it", describeMessage(message), config.Dedup.Key)
+			return handle(ctx, message, config, logFunc)
+		}
+		key = config.GroupID + "/" + key
+
+		seen, err := store.Seen(ctx, key)
+		if err != nil {
+			logFunc("WARNING", "Failed to check dedup store for %s: %v", describeMessage(message), err)
+		} else if seen {
+			logFunc("DEBUG", "Skipping duplicate message %s", describeMessage(message))
+			return ErrSkipMessage
+		}
+
+		if err := handle(ctx, message, config, logFunc); err != nil {
+			return err
+		}
+		if err := store.Mark(ctx, key, ttl); err != nil {
+			logFunc("WARNING", "Failed to record %s in dedup store: %v", describeMessage(message), err)
+		}
+		return nil
+	}
+}
+
+// dedupKey evaluates a dedup key expression for a message: "key" is the message
+// key, "offset" is topic/partition/offset and "value.<path>" is a field of the
+// JSON payload, e.g. "value.order.id". ok is false when the message has no
+// such key.
+func dedupKey(expression string, message kafka.Message) (key string, ok bool) {
+	switch {
+	case expression == "key":
+		return string(message.Key), len(message.Key) > 0
+	case expression == "offset":
+		return describeMessage(message), true
+	case strings.HasPrefix(expression, "value."):
+		var payload interface{}
+		if err := json.Unmarshal(message.Value, &payload); err != nil {
+			return "", false
+		}
+		value, ok := payloadField(payload, strings.TrimPrefix(expression, "value."))
+		if !ok {
+			return "", false
+		}
+		switch value := value.(type) {
+		case nil:
+			return "", false
+		case string:
+			return value, value != ""
+		default:
+			encoded, _ := json.Marshal(value)
+			return string(encoded), true
+		}
+	default:
+		return "", false
+	}
+}
+
+// validateDedupKey checks the syntax of a dedup key expression
+func validateDedupKey(expression string) error {
+	switch {
+	case expression == "key", expression == "offset":
+		return nil
+	case strings.HasPrefix(expression, "value."):
+		for _, field := range strings.Split(strings.TrimPrefix(expression, "value."), ".") {
+			if field == "" {
+				return fmt.Errorf("empty field name in %q", expression)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%q must be key, offset or value.<field path>", expression)
+	}
+}
+
+// memoryDedupStore keeps keys in memory; they are lost on restart
+type memoryDedupStore struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastPurge time.Time
+}
+
+func (s *memoryDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.expires[key]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *memoryDedupStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expires[key] = now.Add(ttl)
+	if now.Sub(s.lastPurge) > dedupPurgeInterval {
+		for key, expires := range s.expires {
+			if !now.Before(expires) {
+				delete(s.expires, key)
+			}
+		}
+		s.lastPurge = now
+	}
+	return nil
+}
+
+func (s *memoryDedupStore) Close() error {
+	return nil
+}
+
+var dedupBucket = []byte("dedup")
+
+// boltDBs shares open bbolt files between consumers, as a file can only be
+// opened once at a time
+var (
+	boltDBsMu sync.Mutex
+	boltDBs   = map[string]*sharedBoltDB{}
+)
+
+type sharedBoltDB struct {
+	db   *bolt.DB
+	refs int
+}
+
+// boltDedupStore keeps keys in a bbolt file with their expiry time
+type boltDedupStore struct {
+	path      string
+	db        *bolt.DB
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func openBoltDedupStore(path string) (*boltDedupStore, error) {
+	boltDBsMu.Lock()
+	defer boltDBsMu.Unlock()
+
+	shared, ok := boltDBs[path]
+	if !ok {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dedup store %s: %w", path, err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(dedupBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open dedup store %s: %w", path, err)
+		}
+		shared = &sharedBoltDB{db: db}
+		boltDBs[path] = shared
+	}
+	shared.refs++
+	return &boltDedupStore{path: path, db: shared.db}, nil
+}
+
+func (s *boltDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	var seen bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(dedupBucket).Get([]byte(key))
+		seen = len(value) == 8 && time.Now().UnixNano() < int64(binary.BigEndian.Uint64(value))
+		return nil
+	})
+	return seen, err
+}
+
+func (s *boltDedupStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	purge := now.Sub(s.lastPurge) > dedupPurgeInterval
+	if purge {
+		s.lastPurge = now
+	}
+	s.mu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dedupBucket)
+		if purge {
+			var expired [][]byte
+			cursor := bucket.Cursor()
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				if len(v) != 8 || now.UnixNano() >= int64(binary.BigEndian.Uint64(v)) {
+					expired = append(expired, k)
+				}
+			}
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		expires := make([]byte, 8)
+		binary.BigEndian.PutUint64(expires, uint64(now.Add(ttl).UnixNano()))
+		return bucket.Put([]byte(key), expires)
+	})
+}
+
+func (s *boltDedupStore) Close() error {
+	boltDBsMu.Lock()
+	defer boltDBsMu.Unlock()
+	shared := boltDBs[s.path]
+	if shared == nil {
+		return nil
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	delete(boltDBs, s.path)
+	return shared.db.Close()
+}
+
+// redisDedupStore keeps keys in Redis, where they expire by themselves
+type redisDedupStore struct {
+	client *redis.Client
+}
+
+const redisDedupPrefix = "mc:dedup:"
+
+func (s *redisDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	count, err := s.client.Exists(ctx, redisDedupPrefix+key).Result()
+	return count > 0, err
+}
+
+func (s *redisDedupStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.Set(ctx, redisDedupPrefix+key, 1, ttl).Err()
+}
+
+func (s *redisDedupStore) Close() error {
+	return s.client.Close()
+}
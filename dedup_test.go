@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestDedupKey(t *testing.T) {
+	message := kafka.Message{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    17,
+		Key:       []byte("order-7"),
+		Value:     []byte(`{"id": "a-1", "order": {"id": 7, "lines": [1, 2]}, "empty": "", "none": null}`),
+	}
+	tests := []struct {
+		expression string
+		message    kafka.Message
+		want       string
+		ok         bool
+	}{
+		{expression: "key", message: message, want: "order-7", ok: true},
+		{expression: "key", message: kafka.Message{Value: message.Value}, ok: false},
+		{expression: "offset", message: message, want: "orders/2@17", ok: true},
+		{expression: "value.id", message: message, want: "a-1", ok: true},
+		{expression: "value.order.id", message: message, want: "7", ok: true},
+		{expression: "value.order.lines", message: message, want: "[1,2]", ok: true},
+		{expression: "value.order", message: message, want: `{"id":7,"lines":[1,2]}`, ok: true},
+		{expression: "value.empty", message: message, ok: false},
+		{expression: "value.none", message: message, ok: false},
+		{expression: "value.missing", message: message, ok: false},
+		{expression: "value.id", message: kafka.Message{Value: []byte("not json")}, ok: false},
+		{expression: "headers.id", message: message, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			got, ok := dedupKey(tt.expression, tt.message)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("dedupKey(%q) = %q, %v, want %q, %v", tt.expression, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateDedupKey(t *testing.T) {
+	for _, expression := range []string{"key", "offset", "value.id", "value.order.id"} {
+		if err := validateDedupKey(expression); err != nil {
+			t.Errorf("validateDedupKey(%q) = %v", expression, err)
+		}
+	}
+	for _, expression := range []string{"", "value.", "value.order..id", "header.id"} {
+		if err := validateDedupKey(expression); err == nil {
+			t.Errorf("validateDedupKey(%q) accepted an invalid expression", expression)
+		}
+	}
+}
+
+func TestWithDedup(t *testing.T) {
+	stores := map[string]func(t *testing.T) DedupStore{
+		"memory": func(t *testing.T) DedupStore {
+			store, err := newDedupStore(DedupConfig{}, RedisConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		"bbolt": func(t *testing.T) DedupStore {
+			store, err := newDedupStore(DedupConfig{Store: "bbolt", Path: filepath.Join(t.TempDir(), "dedup.db")}, RedisConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+	const ttl = 50 * time.Millisecond
+	failure := errors.New("downstream unavailable")
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			var calls int
+			var fail bool
+			config := ConsumerConfig{GroupID: "orders-group", Dedup: &DedupConfig{Key: "key", TTL: Duration(ttl)}}
+			handle := withDedup(config, store, func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				calls++
+				if fail {
+					return failure
+				}
+				return nil
+			})
+			message := kafka.Message{Topic: "orders", Key: []byte("order-7")}
+
+			// A failed call is not recorded, so the message is processed again
+			fail = true
+			if err := handle(context.Background(), message, config, discardLog); !errors.Is(err, failure) {
+				t.Fatalf("error = %v, want the handler's error", err)
+			}
+			fail = false
+			if err := handle(context.Background(), message, config, discardLog); err != nil {
+				t.Fatalf("error = %v after a failed call, want the message processed", err)
+			}
+			if err := handle(context.Background(), message, config, discardLog); !errors.Is(err, ErrSkipMessage) {
+				t.Fatalf("error = %v for a duplicate within the ttl, want ErrSkipMessage", err)
+			}
+			if calls != 2 {
+				t.Fatalf("handler ran %d times, want 2", calls)
+			}
+
+			// Other groups and messages without the key are not deduplicated
+			other := config
+			other.GroupID = "audit-group"
+			if err := handle(context.Background(), message, other, discardLog); err != nil {
+				t.Errorf("error = %v for another group, want the message processed", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := handle(context.Background(), kafka.Message{Topic: "orders"}, config, discardLog); err != nil {
+					t.Errorf("error = %v for a message without a key, want it processed", err)
+				}
+			}
+
+			time.Sleep(ttl)
+			calls = 0
+			if err := handle(context.Background(), message, config, discardLog); err != nil || calls != 1 {
+				t.Errorf("error = %v and %d calls after the ttl, want the message processed", err, calls)
+			}
+		})
+	}
+}
+
+func TestBoltDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	first, err := openBoltDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Consumers with the same path share the open file
+	second, err := openBoltDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := first.Mark(ctx, "orders-group/order-7", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := second.Seen(ctx, "orders-group/order-7"); err != nil || !seen {
+		t.Fatalf("Seen() = %v, %v through the shared file, want true", seen, err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := second.Seen(ctx, "orders-group/order-7"); err != nil || !seen {
+		t.Fatalf("Seen() = %v, %v after the other store closed, want true", seen, err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys survive a restart
+	reopened, err := openBoltDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if seen, err := reopened.Seen(ctx, "orders-group/order-7"); err != nil || !seen {
+		t.Errorf("Seen() = %v, %v after reopening, want true", seen, err)
+	}
+	if seen, err := reopened.Seen(ctx, "orders-group/order-8"); err != nil || seen {
+		t.Errorf("Seen() = %v, %v for an unknown key, want false", seen, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// envSection is implemented by every EnvConfig so that GetEnvConfig can
+// resolve all environment-scoped sections without knowing their types
+type envSection interface {
+	resolveEnv(chain []string) (interface{}, error)
+	environmentNames() []string
+	valueType() reflect.Type
+}
+
+// Resolve merges the entries of the given inheritance chain, root first,
+// resolves secret references and decodes the result into T. Environments
+// missing from the section are skipped.
+func (e EnvConfig[T]) Resolve(chain []string) (T, error) {
+	var result T
+	var merged interface{}
+	for _, name := range chain {
+		raw, ok := e[name]
+		if !ok {
+			continue
+		}
+		var tree interface{}
+		if err := json.Unmarshal(raw, &tree); err != nil {
+			return result, fmt.Errorf("environment %s: %w", name, err)
+		}
+		merged = mergeTrees(merged, tree)
+	}
+	if merged == nil {
+		return result, nil
+	}
+
+	merged, err := resolveSecrets(merged, "", nil)
+	if err != nil {
+		return result, fmt.Errorf("environment %s: %w", chain[len(chain)-1], err)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("environment %s: %w", chain[len(chain)-1], err)
+	}
+	return result, nil
+}
+
+func (e EnvConfig[T]) resolveEnv(chain []string) (interface{}, error) {
+	return e.Resolve(chain)
+}
+
+func (e EnvConfig[T]) valueType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+func (e EnvConfig[T]) environmentNames() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	return names
+}
+
+// mergeTrees deep-merges two decoded JSON values. Objects are merged key by
+// key; any other value in override replaces the one in base.
+func mergeTrees(base, override interface{}) interface{} {
+	baseMap, baseOK := base.(map[string]interface{})
+	overrideMap, overrideOK := override.(map[string]interface{})
+	if !baseOK || !overrideOK {
+		return override
+	}
+
+	merged := make(map[string]interface{}, len(baseMap)+len(overrideMap))
+	for key, value := range baseMap {
+		merged[key] = value
+	}
+	for key, value := range overrideMap {
+		merged[key] = mergeTrees(merged[key], value)
+	}
+	return merged
+}
+
+// namedSection is an environment-scoped section with its Go field name and JSON key
+type namedSection struct {
+	field   string
+	key     string
+	section envSection
+}
+
+// envSections returns the environment-scoped sections of the config in declaration order
+func (c FullConfig) envSections() []namedSection {
+	var sections []namedSection
+	value := reflect.ValueOf(c)
+	for i := 0; i < value.NumField(); i++ {
+		if section, ok := value.Field(i).Interface().(envSection); ok {
+			field := value.Type().Field(i)
+			sections = append(sections, namedSection{field: field.Name, key: jsonName(field), section: section})
+		}
+	}
+	return sections
+}
+
+// jsonName returns the key a struct field is encoded under
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// EnvironmentNames lists every environment declared in "environments" or used
+// as a key in any environment-scoped section
+func (c FullConfig) EnvironmentNames() []string {
+	seen := make(map[string]bool)
+	for name := range c.Environments {
+		seen[name] = true
+	}
+	for _, named := range c.envSections() {
+		for _, name := range named.section.environmentNames() {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// environmentChain returns the inheritance chain of env, root first
+func (c FullConfig) environmentChain(env string) ([]string, error) {
+	known := false
+	for _, name := range c.EnvironmentNames() {
+		if name == env {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown environment: %s (available: %s)", env, strings.Join(c.EnvironmentNames(), ", "))
+	}
+
+	var chain []string
+	visited := make(map[string]bool)
+	for name := env; name != ""; name = c.Environments[name].Extends {
+		if visited[name] {
+			return nil, fmt.Errorf("environment %s: circular extends via %s", env, name)
+		}
+		if _, declared := c.Environments[name]; !declared && name != env {
+			return nil, fmt.Errorf("environment %s: extends undeclared environment %s", chain[0], name)
+		}
+		visited[name] = true
+		chain = append([]string{name}, chain...)
+	}
+	return chain, nil
+}
+
+// GetEnvConfig resolves every environment-scoped section of the config for env,
+// following its "extends" chain
+func GetEnvConfig(env string, config FullConfig) (*Environment, error) {
+	chain, err := config.environmentChain(env)
+	if err != nil {
+		return nil, err
+	}
+
+	environment := &Environment{Name: env}
+	target := reflect.ValueOf(environment).Elem()
+	for _, named := range config.envSections() {
+		resolved, err := named.section.resolveEnv(chain)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", named.key, err)
+		}
+		if field := target.FieldByName(named.field); field.IsValid() {
+			field.Set(reflect.ValueOf(resolved))
+		}
+	}
+	return environment, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvironmentChain(t *testing.T) {
+	config := FullConfig{
+		Environments: map[string]EnvironmentDef{
+			"base":       {},
+			"staging":    {Extends: "base"},
+			"production": {Extends: "staging"},
+			"loop-a":     {Extends: "loop-b"},
+			"loop-b":     {Extends: "loop-a"},
+			"self":       {Extends: "self"},
+			"broken":     {Extends: "missing"},
+		},
+		Redis: EnvConfig[RedisConfig]{"development": nil},
+	}
+
+	tests := []struct {
+		env   string
+		chain []string
+		err   string
+	}{
+		{env: "base", chain: []string{"base"}},
+		{env: "production", chain: []string{"base", "staging", "production"}},
+		{env: "development", chain: []string{"development"}},
+		{env: "loop-a", err: "environment loop-a: circular extends via loop-a"},
+		{env: "self", err: "environment self: circular extends via self"},
+		{env: "broken", err: "environment broken: extends undeclared environment missing"},
+		{env: "unknown", err: "unknown environment: unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			chain, err := config.environmentChain(tt.env)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(chain, tt.chain) {
+				t.Errorf("chain = %v, want %v", chain, tt.chain)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultHandlerRetries = 3
+	defaultRetryBackoff   = time.Second
+	maxRetryBackoff       = 30 * time.Second
+)
+
+// ErrCommitBlocked wraps the error of a handler whose failure must keep the
+// message uncommitted. The consumer retries the message instead of committing it.
+var ErrCommitBlocked = errors.New("commit blocked")
+
+// fanOutHandler is a HandlerConfig bound to its handler
+type fanOutHandler struct {
+	name    string
+	config  ConsumerConfig
+	policy  string
+	retries int
+	backoff time.Duration
+	handle  func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error
+	close   func() error
+}
+
+// retriedMessage holds the handlers done with a message awaiting a retry
+type retriedMessage struct {
+	offset int64
+	done   map[int]bool
+}
+
+// newFanOut binds every entry of the consumer's handlers list and returns a
+// handler that runs all of them for each message. When a blocking handler
+// fails, the consumer retries the message and only the blocking handlers that
+// have not succeeded yet run again.
+func newFanOut(config ConsumerConfig, deps HandlerDeps, dedup bool) (handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error, close func() error, err error) {
+	var handlers []*fanOutHandler
+	closeHandlers := func() error {
+		var errs []error
+		for _, h := range handlers {
+			errs = append(errs, h.close())
+		}
+		return errors.Join(errs...)
+	}
+
+	for i, handlerConfig := range config.Handlers {
+		h := &fanOutHandler{
+			name:    handlerConfig.Name,
+			policy:  handlerConfig.OnFailure,
+			retries: defaultHandlerRetries,
+			backoff: defaultRetryBackoff,
+		}
+		if h.name == "" {
+			h.name = fmt.Sprintf("handlers[%d]", i)
+		}
+		if h.policy == "" {
+			h.policy = "block"
+		}
+		if handlerConfig.Retries != nil {
+			h.retries = *handlerConfig.Retries
+		}
+		if handlerConfig.RetryBackoff > 0 {
+			h.backoff = time.Duration(handlerConfig.RetryBackoff)
+		}
+		h.config = config.withHandler(handlerConfig.HandlerName, handlerConfig.Settings)
+
+		h.handle, h.close, err = newMessageHandler(h.config, deps, dedup)
+		if err != nil {
+			closeHandlers()
+			return nil, nil, fmt.Errorf("handler %s: %w", h.name, err)
+		}
+		handlers = append(handlers, h)
+	}
+
+	// succeeded remembers which handlers are done with the message awaiting a
+	// retry in each partition. A partition handles one message at a time, so a
+	// message at another offset replaces the entry of one that was not retried.
+	var mu sync.Mutex
+	succeeded := make(map[sourcePartition]retriedMessage)
+	parallel := config.Execution == "parallel"
+
+	handle = func(ctx context.Context, message kafka.Message, _ ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+		source := sourcePartition{topic: message.Topic, partition: message.Partition}
+		mu.Lock()
+		entry, ok := succeeded[source]
+		if !ok || entry.offset != message.Offset {
+			entry = retriedMessage{offset: message.Offset, done: make(map[int]bool)}
+			succeeded[source] = entry
+		}
+		done := entry.done
+		mu.Unlock()
+
+		errs := make([]error, len(handlers))
+		run := func(i int) {
+			mu.Lock()
+			skip := done[i]
+			mu.Unlock()
+			if skip {
+				return
+			}
+			// Only blocking handlers run again when the message is retried
+			if errs[i] = handlers[i].run(ctx, message, logFunc); errs[i] == nil || handlers[i].policy != "block" {
+				mu.Lock()
+				done[i] = true
+				mu.Unlock()
+			}
+		}
+		if parallel {
+			var wg sync.WaitGroup
+			for i := range handlers {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					run(i)
+				}(i)
+			}
+			wg.Wait()
+		} else {
+			// In sequence a blocking failure stops the handlers after it
+			for i := range handlers {
+				if run(i); errs[i] != nil && handlers[i].policy == "block" {
+					break
+				}
+			}
+		}
+
+		var failures []error
+		blocked := false
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			failures = append(failures, fmt.Errorf("handler %s: %w", handlers[i].name, err))
+			blocked = blocked || handlers[i].policy == "block"
+		}
+		if blocked {
+			return fmt.Errorf("%w: %w", ErrCommitBlocked, errors.Join(failures...))
+		}
+		mu.Lock()
+		delete(succeeded, source)
+		mu.Unlock()
+		return errors.Join(failures...)
+	}
+	return handle, closeHandlers, nil
+}
+
+// call makes one call of the handler. A panic is recovered as ErrHandlerPanic,
+// so that it fails the handler under its own policy.
+func (h *fanOutHandler) call(ctx context.Context, message kafka.Message, logFunc func(level string, msg string, args ...interface{})) (err error) {
+	defer recoverHandlerPanic(&err, message, logFunc)
+	return h.handle(ctx, message, h.config, logFunc)
+}
+
+// hasBlockingHandler reports whether a handler of the consumer's handlers list
+// has the block policy. Such a consumer keeps a message uncommitted when its
+// handlers run past handler_timeout, as the timeout leaves their outcome unknown.
+func hasBlockingHandler(config ConsumerConfig) bool {
+	for _, handler := range config.Handlers {
+		if handler.OnFailure == "" || handler.OnFailure == "block" {
+			return true
+		}
+	}
+	return false
+}
+
+// run calls the handler, retrying it as its policy allows until ctx ends. A
+// skipped message counts as handled.
+func (h *fanOutHandler) run(ctx context.Context, message kafka.Message, logFunc func(level string, msg string, args ...interface{})) (err error) {
+	ctx, span := tracer.Start(ctx, "handler "+h.name, trace.WithAttributes(attribute.String("multiconsumer.handler", h.config.HandlerName)))
+	attempts := 0
+	defer func() { endMessageSpan(span, attempts, err) }()
+
+	backoff := h.backoff
+	for attempt := 1; ; attempt++ {
+		attempts = attempt
+		err = h.call(ctx, message, logFunc)
+		if err == nil || errors.Is(err, ErrSkipMessage) {
+			return nil
+		}
+		if h.policy != "retry" || attempt > h.retries {
+			return err
+		}
+		logFunc("WARNING", "Handler %s failed for message %s (attempt %d of %d), retrying in %s: %v",
+			h.name, describeMessage(message), attempt, h.retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// registerTestHandler adds a handler to the registry for the duration of the test
+func registerTestHandler(t *testing.T, name string, handle HandlerFunc) {
+	t.Helper()
+	handlerRegistry[name] = HandlerSpec{Handle: handle}
+	t.Cleanup(func() { delete(handlerRegistry, name) })
+}
+
+func TestFanOutPanic(t *testing.T) {
+	var panics, after atomic.Int32
+	var fixed atomic.Bool
+	registerTestHandler(t, "test_panic", func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}), deps HandlerDeps) error {
+		if !fixed.Load() {
+			panics.Add(1)
+			panic("boom")
+		}
+		return nil
+	})
+	registerTestHandler(t, "test_after", func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}), deps HandlerDeps) error {
+		after.Add(1)
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		execution string
+		policy    string
+		blocked   bool
+		after     int32 // calls of the second handler while the first one panics
+	}{
+		{name: "sequential block", execution: "sequential", policy: "block", blocked: true, after: 0},
+		{name: "parallel block", execution: "parallel", policy: "block", blocked: true, after: 1},
+		{name: "sequential log", execution: "sequential", policy: "log", after: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			panics.Store(0)
+			after.Store(0)
+			fixed.Store(false)
+			config := ConsumerConfig{
+				Name:      "test",
+				Execution: tt.execution,
+				Handlers: []HandlerConfig{
+					{Name: "first", HandlerName: "test_panic", OnFailure: tt.policy},
+					{Name: "second", HandlerName: "test_after", OnFailure: "block"},
+				},
+			}
+			handle, closeHandlers, err := newFanOut(config, HandlerDeps{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeHandlers()
+			message := kafka.Message{Topic: "cities", Partition: 0, Offset: 42}
+
+			err = handle(context.Background(), message, config, discardLog)
+			if !errors.Is(err, ErrHandlerPanic) {
+				t.Fatalf("error = %v, want ErrHandlerPanic", err)
+			}
+			if errors.Is(err, ErrCommitBlocked) != tt.blocked {
+				t.Fatalf("error = %v, want blocked = %v", err, tt.blocked)
+			}
+			if panics.Load() != 1 || after.Load() != tt.after {
+				t.Fatalf("calls = %d and %d, want 1 and %d", panics.Load(), after.Load(), tt.after)
+			}
+			if !tt.blocked {
+				return
+			}
+
+			// The retry runs the handlers that have not succeeded yet, once each
+			fixed.Store(true)
+			if err := handle(context.Background(), message, config, discardLog); err != nil {
+				t.Fatalf("retry failed: %v", err)
+			}
+			if after.Load() != 1 {
+				t.Errorf("second handler ran %d times, want 1", after.Load())
+			}
+		})
+	}
+}
+
+func TestFanOutTimeoutBlocksCommit(t *testing.T) {
+	registerTestHandler(t, "test_slow", func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}), deps HandlerDeps) error {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		return ctx.Err()
+	})
+
+	tests := []struct {
+		policy  string
+		blocked bool
+	}{
+		{policy: "block", blocked: true},
+		{policy: "log", blocked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config := ConsumerConfig{
+				Name:           "test-timeout-" + tt.policy,
+				HandlerTimeout: Duration(10 * time.Millisecond),
+				Handlers:       []HandlerConfig{{HandlerName: "test_slow", OnFailure: tt.policy}},
+			}
+			handle, closeHandlers, err := newFanOut(config, HandlerDeps{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeHandlers()
+
+			err = runHandler(context.Background(), config, handle, kafka.Message{Topic: "cities"}, discardLog, newAbandonedCalls(config))
+			if !errors.Is(err, ErrHandlerTimeout) {
+				t.Fatalf("error = %v, want ErrHandlerTimeout", err)
+			}
+			if errors.Is(err, ErrCommitBlocked) != tt.blocked {
+				t.Errorf("error = %v, want blocked = %v", err, tt.blocked)
+			}
+		})
+	}
+}
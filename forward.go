@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers written on every forwarded message, identifying the source message
+// and which of its outputs it is
+const (
+	sourceTopicHeader     = "mc-source-topic"
+	sourcePartitionHeader = "mc-source-partition"
+	sourceOffsetHeader    = "mc-source-offset"
+	sourceIndexHeader     = "mc-source-index"
+)
+
+const defaultDedupWindow = 1000
+
+// sourcePartition identifies a partition of a source topic
+type sourcePartition struct {
+	topic     string
+	partition int
+}
+
+// forwardedOutputs records the latest forwarded offset of a source partition
+// and which outputs of that offset were written
+type forwardedOutputs struct {
+	offset  int64
+	indexes map[int]bool
+}
+
+// forwarder writes the output of a forwarding handler to the forward topic
+// through the shared producer.
+//
+// kafka-go cannot produce transactionally: its record batches never carry a
+// producer ID, so output and consumer offsets cannot be committed in one
+// transaction. Instead every output carries the source topic, partition, offset
+// and output index in its headers. When a source partition is (re)assigned, or
+// after any other gap in its offsets, the forwarder scans the tail of the
+// forward topic and skips outputs that were written before the source offset
+// was committed. The messages of a source partition are handled one at a time,
+// so its outputs are written in offset order and the latest one found is the
+// only one that may be incomplete. With partition_parallelism, Handle is called
+// for several partitions at once: each source partition has its own lock, mu
+// guards the shared maps and scans run one at a time.
+type forwarder struct {
+	config    ConsumerConfig
+	transform TransformFunc
+	producer  *Producer
+	client    *kafka.Client
+	dialer    *kafka.Dialer
+	dedup     bool
+
+	mu        sync.Mutex
+	locks     map[sourcePartition]*sync.Mutex
+	forwarded map[sourcePartition]forwardedOutputs
+	lastSeen  map[sourcePartition]int64
+
+	scanMu   sync.Mutex
+	scans    atomic.Int64 // scans started
+	lastScan int64        // number of the latest scan that succeeded
+}
+
+func newForwarder(config ConsumerConfig, transform TransformFunc, producer *Producer, dedup bool) (*forwarder, error) {
+	client, err := newClient(config.KafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newDialer(config.KafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwarder{
+		config:    config,
+		transform: transform,
+		producer:  producer,
+		client:    client,
+		dialer:    dialer,
+		dedup:     dedup,
+		locks:     make(map[sourcePartition]*sync.Mutex),
+		forwarded: make(map[sourcePartition]forwardedOutputs),
+		lastSeen:  make(map[sourcePartition]int64),
+	}, nil
+}
+
+// Handle transforms a message and writes its outputs to the forward topic,
+// skipping outputs that were already forwarded. It returns ErrSkipMessage when
+// every output of the message was already forwarded.
+func (f *forwarder) Handle(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+	source := sourcePartition{topic: message.Topic, partition: message.Partition}
+	lock := f.partitionLock(source)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if f.dedup {
+		f.mu.Lock()
+		last, seen := f.lastSeen[source]
+		f.mu.Unlock()
+		if !seen || last != message.Offset-1 {
+			if err := f.scan(ctx); err != nil {
+				return fmt.Errorf("failed to read forwarded offsets from %s: %w", f.config.Forward.Topic, err)
+			}
+		}
+	}
+	f.mu.Lock()
+	if f.dedup {
+		f.lastSeen[source] = message.Offset
+	}
+	previous, found := f.forwarded[source]
+	f.mu.Unlock()
+	if found && message.Offset < previous.offset {
+		return ErrSkipMessage
+	}
+
+	outputs, err := f.transform(ctx, message, config, logFunc)
+	if err != nil {
+		return err
+	}
+
+	var pending []kafka.Message
+	for i, output := range outputs {
+		if found && message.Offset == previous.offset && previous.indexes[i] {
+			continue
+		}
+		output.Topic = f.config.Forward.Topic
+		output.Headers = append(withoutSourceHeaders(output.Headers), sourceHeaders(message, i)...)
+		pending = append(pending, output)
+	}
+	if len(pending) == 0 {
+		if len(outputs) > 0 {
+			return ErrSkipMessage
+		}
+		return nil
+	}
+
+	if err := f.producer.Produce(ctx, pending...); err != nil {
+		return fmt.Errorf("failed to forward: %w", err)
+	}
+	logFunc("DEBUG", "Forwarded %d message(s) for %s to %s", len(pending), describeMessage(message), f.config.Forward.Topic)
+	return nil
+}
+
+// partitionLock returns the lock that orders the messages of a source partition
+func (f *forwarder) partitionLock(source sourcePartition) *sync.Mutex {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lock, ok := f.locks[source]
+	if !ok {
+		lock = &sync.Mutex{}
+		f.locks[source] = lock
+	}
+	return lock
+}
+
+// scan reads the latest dedup_window messages of every partition of the forward
+// topic and records the latest forwarded outputs per source partition. Scans
+// run one at a time; a caller that waited for a scan started after its call
+// uses that one, if it succeeded, instead of reading the topic again.
+func (f *forwarder) scan(ctx context.Context) error {
+	requested := f.scans.Load()
+	f.scanMu.Lock()
+	defer f.scanMu.Unlock()
+	if f.lastScan > requested {
+		return nil
+	}
+	number := f.scans.Add(1)
+
+	topic := f.config.Forward.Topic
+	window := int64(f.config.Forward.DedupWindow)
+	if window == 0 {
+		window = defaultDedupWindow
+	}
+
+	partitions, err := topicPartitions(ctx, f.client, []string{topic})
+	if err != nil {
+		return err
+	}
+	marks, err := fetchWatermarks(ctx, f.client, partitions)
+	if err != nil {
+		return err
+	}
+	found := make(map[sourcePartition]forwardedOutputs)
+	for _, partition := range partitions[topic] {
+		mark := marks[topic][partition]
+		start := mark.Last - window
+		if start < mark.First {
+			start = mark.First
+		}
+		err := readRange(ctx, f.config.KafkaConfig, f.dialer, topic, partition, start, mark.Last, func(message kafka.Message) error {
+			recordForwarded(found, message)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errRangeIdle) {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for source, outputs := range found {
+		if previous, ok := f.forwarded[source]; !ok || outputs.offset >= previous.offset {
+			f.forwarded[source] = outputs
+		}
+	}
+	f.lastScan = number
+	return nil
+}
+
+// recordForwarded notes in forwarded a message found in the forward topic
+func recordForwarded(forwarded map[sourcePartition]forwardedOutputs, message kafka.Message) {
+	headers := make(map[string]string)
+	for _, header := range message.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	partition, errPartition := strconv.Atoi(headers[sourcePartitionHeader])
+	offset, errOffset := strconv.ParseInt(headers[sourceOffsetHeader], 10, 64)
+	index, errIndex := strconv.Atoi(headers[sourceIndexHeader])
+	if headers[sourceTopicHeader] == "" || errPartition != nil || errOffset != nil || errIndex != nil {
+		return
+	}
+
+	source := sourcePartition{topic: headers[sourceTopicHeader], partition: partition}
+	previous, found := forwarded[source]
+	switch {
+	case !found || offset > previous.offset:
+		forwarded[source] = forwardedOutputs{offset: offset, indexes: map[int]bool{index: true}}
+	case offset == previous.offset:
+		previous.indexes[index] = true
+	}
+}
+
+// Close releases the connections used for scans. The shared producer is
+// closed once every consumer has stopped.
+func (f *forwarder) Close() error {
+	closeClient(f.client)
+	return nil
+}
+
+// sourceHeaders tags output number index of a source message
+func sourceHeaders(message kafka.Message, index int) []kafka.Header {
+	return []kafka.Header{
+		{Key: sourceTopicHeader, Value: []byte(message.Topic)},
+		{Key: sourcePartitionHeader, Value: []byte(strconv.Itoa(message.Partition))},
+		{Key: sourceOffsetHeader, Value: []byte(strconv.FormatInt(message.Offset, 10))},
+		{Key: sourceIndexHeader, Value: []byte(strconv.Itoa(index))},
+	}
+}
+
+// withoutSourceHeaders drops source headers copied from a message that was
+// itself forwarded, so that they do not shadow the new ones
+func withoutSourceHeaders(headers []kafka.Header) []kafka.Header {
+	var kept []kafka.Header
+	for _, header := range headers {
+		switch header.Key {
+		case sourceTopicHeader, sourcePartitionHeader, sourceOffsetHeader, sourceIndexHeader:
+		default:
+			kept = append(kept, header)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// fakeBroker is a kafka.RoundTripper for a single broker with single-partition
+// topics that keeps the messages produced to it
+type fakeBroker struct {
+	mu       sync.Mutex
+	produced []kafka.Message
+}
+
+func (b *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, request kafka.Request) (kafka.Response, error) {
+	switch request := request.(type) {
+	case *metadata.Request:
+		response := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}}}
+		for _, topic := range request.TopicNames {
+			response.Topics = append(response.Topics, metadata.ResponseTopic{
+				Name:       topic,
+				Partitions: []metadata.ResponsePartition{{LeaderID: 1, ReplicaNodes: []int32{1}, IsrNodes: []int32{1}}},
+			})
+		}
+		return response, nil
+	case *produce.Request:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		response := &produce.Response{}
+		for _, topic := range request.Topics {
+			responseTopic := produce.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				for {
+					record, err := partition.RecordSet.Records.ReadRecord()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					message := kafka.Message{Topic: topic.Topic, Partition: int(partition.Partition)}
+					message.Key, _ = protocol.ReadAll(record.Key)
+					message.Value, _ = protocol.ReadAll(record.Value)
+					for _, header := range record.Headers {
+						message.Headers = append(message.Headers, kafka.Header{Key: header.Key, Value: header.Value})
+					}
+					b.produced = append(b.produced, message)
+				}
+				responseTopic.Partitions = append(responseTopic.Partitions, produce.ResponsePartition{Partition: partition.Partition})
+			}
+			response.Topics = append(response.Topics, responseTopic)
+		}
+		return response, nil
+	default:
+		return nil, fmt.Errorf("unexpected request %T", request)
+	}
+}
+
+// newTestForwarder returns a forwarder to the topic "forwarded" of b that
+// transforms every message into outputs messages. The source partition of
+// "orders" starts as if offset 9 was the last message handled, so Handle does
+// not scan the forward topic.
+func newTestForwarder(b *fakeBroker, outputs int) *forwarder {
+	const topic = "forwarded"
+	producer := &Producer{writers: map[string]*kafka.Writer{
+		topic: {Addr: kafka.TCP("localhost:9092"), Topic: topic, Transport: b, Balancer: &kafka.Hash{}, BatchTimeout: time.Millisecond},
+	}}
+	transform := func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) ([]kafka.Message, error) {
+		var messages []kafka.Message
+		for i := 0; i < outputs; i++ {
+			messages = append(messages, kafka.Message{Value: []byte(fmt.Sprintf("%d-%d", message.Offset, i))})
+		}
+		return messages, nil
+	}
+	return &forwarder{
+		config:    ConsumerConfig{Name: "test-forward", Forward: &ForwardConfig{Topic: topic}},
+		transform: transform,
+		producer:  producer,
+		dedup:     true,
+		locks:     make(map[sourcePartition]*sync.Mutex),
+		forwarded: make(map[sourcePartition]forwardedOutputs),
+		lastSeen:  map[sourcePartition]int64{{topic: "orders", partition: 0}: 9},
+	}
+}
+
+func TestForwarderHandle(t *testing.T) {
+	source := sourcePartition{topic: "orders", partition: 0}
+	tests := []struct {
+		name      string
+		outputs   int
+		forwarded *forwardedOutputs // found in the forward topic
+		want      []string          // values produced
+		err       error
+	}{
+		{name: "nothing forwarded yet", outputs: 2, want: []string{"10-0", "10-1"}},
+		{name: "earlier offset forwarded", outputs: 2, forwarded: &forwardedOutputs{offset: 8, indexes: map[int]bool{0: true}}, want: []string{"10-0", "10-1"}},
+		{name: "later offset forwarded", outputs: 2, forwarded: &forwardedOutputs{offset: 11, indexes: map[int]bool{0: true}}, err: ErrSkipMessage},
+		{name: "partly forwarded", outputs: 3, forwarded: &forwardedOutputs{offset: 10, indexes: map[int]bool{0: true, 2: true}}, want: []string{"10-1"}},
+		{name: "fully forwarded", outputs: 2, forwarded: &forwardedOutputs{offset: 10, indexes: map[int]bool{0: true, 1: true}}, err: ErrSkipMessage},
+		{name: "no outputs", outputs: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := &fakeBroker{}
+			f := newTestForwarder(broker, tt.outputs)
+			if tt.forwarded != nil {
+				f.forwarded[source] = *tt.forwarded
+			}
+			message := kafka.Message{Topic: "orders", Partition: 0, Offset: 10}
+
+			err := f.Handle(context.Background(), message, f.config, discardLog)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			var got []string
+			for _, produced := range broker.produced {
+				got = append(got, string(produced.Value))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("produced %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedOutputsAreTagged(t *testing.T) {
+	broker := &fakeBroker{}
+	f := newTestForwarder(broker, 2)
+	message := kafka.Message{Topic: "orders", Partition: 0, Offset: 10}
+	if err := f.Handle(context.Background(), message, f.config, discardLog); err != nil {
+		t.Fatal(err)
+	}
+
+	// The outputs found by a later scan resume after them
+	found := make(map[sourcePartition]forwardedOutputs)
+	for _, produced := range broker.produced {
+		recordForwarded(found, produced)
+	}
+	want := map[sourcePartition]forwardedOutputs{{topic: "orders", partition: 0}: {offset: 10, indexes: map[int]bool{0: true, 1: true}}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("recorded %+v, want %+v", found, want)
+	}
+}
+
+func TestRecordForwarded(t *testing.T) {
+	tagged := func(topic string, partition int, offset int64, index int) kafka.Message {
+		return kafka.Message{Headers: sourceHeaders(kafka.Message{Topic: topic, Partition: partition, Offset: offset}, index)}
+	}
+	tests := []struct {
+		name     string
+		messages []kafka.Message
+		want     map[sourcePartition]forwardedOutputs
+	}{
+		{
+			name:     "outputs of one offset",
+			messages: []kafka.Message{tagged("orders", 0, 5, 0), tagged("orders", 0, 5, 1)},
+			want:     map[sourcePartition]forwardedOutputs{{"orders", 0}: {offset: 5, indexes: map[int]bool{0: true, 1: true}}},
+		},
+		{
+			name:     "later offset replaces",
+			messages: []kafka.Message{tagged("orders", 0, 5, 0), tagged("orders", 0, 5, 1), tagged("orders", 0, 6, 0)},
+			want:     map[sourcePartition]forwardedOutputs{{"orders", 0}: {offset: 6, indexes: map[int]bool{0: true}}},
+		},
+		{
+			name:     "earlier offset is ignored",
+			messages: []kafka.Message{tagged("orders", 0, 6, 1), tagged("orders", 0, 5, 0)},
+			want:     map[sourcePartition]forwardedOutputs{{"orders", 0}: {offset: 6, indexes: map[int]bool{1: true}}},
+		},
+		{
+			name:     "source partitions are kept apart",
+			messages: []kafka.Message{tagged("orders", 0, 5, 0), tagged("orders", 1, 3, 0), tagged("refunds", 0, 9, 2)},
+			want: map[sourcePartition]forwardedOutputs{
+				{"orders", 0}:  {offset: 5, indexes: map[int]bool{0: true}},
+				{"orders", 1}:  {offset: 3, indexes: map[int]bool{0: true}},
+				{"refunds", 0}: {offset: 9, indexes: map[int]bool{2: true}},
+			},
+		},
+		{
+			name: "messages without source headers",
+			messages: []kafka.Message{
+				{Value: []byte("written by another producer")},
+				{Headers: []kafka.Header{{Key: sourceTopicHeader, Value: []byte("orders")}, {Key: sourcePartitionHeader, Value: []byte("x")}}},
+			},
+			want: map[sourcePartition]forwardedOutputs{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := make(map[sourcePartition]forwardedOutputs)
+			for _, message := range tt.messages {
+				recordForwarded(found, message)
+			}
+			if !reflect.DeepEqual(found, tt.want) {
+				t.Errorf("recorded %+v, want %+v", found, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutSourceHeaders(t *testing.T) {
+	headers := append([]kafka.Header{{Key: "tenant", Value: []byte("acme")}}, sourceHeaders(kafka.Message{Topic: "orders", Offset: 4}, 1)...)
+	got := withoutSourceHeaders(headers)
+	if want := []kafka.Header{{Key: "tenant", Value: []byte("acme")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fetchRetryDelay is how long a partition reader waits after a fetch error
+// before it reconnects
+const fetchRetryDelay = 5 * time.Second
+
+var (
+	rebalancesTotal    = metrics.counter("multiconsumer_rebalances_total", "Consumer group generations joined, including the first.", "consumer")
+	assignedPartitions = metrics.gauge("multiconsumer_assigned_partitions", "Partitions assigned in the current generation.", "consumer")
+)
+
+// consumeGroup joins the consumer group for topics and runs each generation the
+// group goes through until ctx ends
+func (kc *KafkaConsumer) consumeGroup(ctx context.Context, topics []string) error {
+	group, err := createConsumerGroup(kc.consumerConfig, topics, kc.dialer, kc.logger)
+	if err != nil {
+		return err
+	}
+	// Closing the group ends the running generation, which commits before leaving
+	defer group.Close()
+
+	var disconnected bool
+	for {
+		gen, err := group.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			switch {
+			case errors.Is(err, kafka.RebalanceInProgress):
+				kc.logger("DEBUG", "Consumer group is rebalancing: %v", err)
+			case !disconnected:
+				kc.logger("ERROR", "Lost connection to the consumer group: %v. Retrying...", err)
+				disconnected = true
+			}
+			continue
+		}
+		if disconnected {
+			kc.logger("INFO", "Reconnected to Kafka successfully. Consumer is ready.")
+			disconnected = false
+		}
+		kc.runGeneration(gen)
+	}
+}
+
+// runGeneration starts the work of one generation. Messages are handled in
+// lanes, each with its own handler loop and committer: one lane for all
+// assigned partitions or, with partition_parallelism, one per partition. Every
+// partition has its own reader feeding its lane. kafka-go ends the generation
+// on a rebalance or when the group closes; the lanes then finish their current
+// message, and the OnRevoked hooks run and offsets are committed before the
+// partitions are given up.
+func (kc *KafkaConsumer) runGeneration(gen *kafka.Generation) {
+	partitions := generationPartitions(gen.Assignments)
+	rebalancesTotal.Inc(kc.consumerConfig.Name)
+	assignedPartitions.Set(float64(len(partitions)), kc.consumerConfig.Name)
+	kc.logger("INFO", "Assigned %s in generation %d", describePartitions(partitions), gen.ID)
+
+	offsets := make(map[TopicPartition]int64)
+	for topic, assigned := range gen.Assignments {
+		for _, partition := range assigned {
+			offsets[TopicPartition{Topic: topic, Partition: partition.ID}] = partition.Offset
+		}
+	}
+	lanes := [][]TopicPartition{partitions}
+	if kc.consumerConfig.PartitionParallelism {
+		lanes = nil
+		for _, partition := range partitions {
+			lanes = append(lanes, []TopicPartition{partition})
+		}
+	}
+	committers := make([]*committer, len(lanes))
+	for i, lane := range lanes {
+		committers[i] = newCommitter(kc.consumerConfig, gen, lane, kc.logger)
+	}
+	kc.setCommitters(committers)
+	kc.lag.assign(partitions)
+
+	gen.Start(func(ctx context.Context) {
+		kc.hooks.assigned(partitions, kc.logger)
+
+		var wg sync.WaitGroup
+		for i, lane := range lanes {
+			messages := make(chan kafka.Message)
+			for _, partition := range lane {
+				gen.Start(func(ctx context.Context) {
+					kc.fetchPartition(ctx, partition, offsets[partition], messages)
+				})
+			}
+			gen.Start(committers[i].run)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				kc.handleLane(ctx, messages, committers[i])
+			}()
+		}
+		wg.Wait()
+
+		kc.hooks.revoked(partitions, kc.logger)
+		for _, c := range committers {
+			c.flush()
+			c.release()
+		}
+		kc.setCommitters(nil)
+		kc.lag.assign(nil)
+		assignedPartitions.Set(0, kc.consumerConfig.Name)
+		kc.logger("INFO", "Revoked %s at the end of generation %d", describePartitions(partitions), gen.ID)
+	})
+}
+
+// handleLane passes the messages of a lane to the handler, one at a time, and
+// marks them for commit until the generation ends
+func (kc *KafkaConsumer) handleLane(ctx context.Context, messages <-chan kafka.Message, c *committer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-messages:
+			if !kc.limiter.acquire(ctx, message) {
+				return
+			}
+			ok := kc.process(ctx, message)
+			kc.limiter.release()
+			if !ok {
+				return // Revoked while the message was blocked; leave it uncommitted
+			}
+			c.processed(message)
+		}
+	}
+}
+
+// fetchPartition reads one assigned partition from offset and hands its
+// messages to its lane until the generation ends
+func (kc *KafkaConsumer) fetchPartition(ctx context.Context, partition TopicPartition, offset int64, messages chan<- kafka.Message) {
+	fetch := func(reader *kafka.Reader) error {
+		defer reader.Close()
+		if err := reader.SetOffset(offset); err != nil {
+			return err
+		}
+		for {
+			message, err := reader.FetchMessage(ctx)
+			if err != nil {
+				return err
+			}
+			select {
+			case messages <- message:
+				offset = message.Offset + 1
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	for {
+		err := fetch(createPartitionReader(kc.consumerConfig, partition.Topic, partition.Partition, kc.dialer, kc.logger))
+		if ctx.Err() != nil {
+			return
+		}
+		kc.logger("ERROR", "Failed to fetch from %s/%d, retrying in %s: %v", partition.Topic, partition.Partition, fetchRetryDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(fetchRetryDelay):
+		}
+	}
+}
+
+// generationPartitions lists the partitions assigned in a generation, sorted
+func generationPartitions(assignments map[string][]kafka.PartitionAssignment) []TopicPartition {
+	var partitions []TopicPartition
+	for topic, assigned := range assignments {
+		for _, partition := range assigned {
+			partitions = append(partitions, TopicPartition{Topic: topic, Partition: partition.ID})
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Topic != partitions[j].Topic {
+			return partitions[i].Topic < partitions[j].Topic
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+	return partitions
+}
+
+// describePartitions formats partitions for log messages, e.g. "orders/0, orders/1"
+func describePartitions(partitions []TopicPartition) string {
+	if len(partitions) == 0 {
+		return "no partitions"
+	}
+	names := make([]string, len(partitions))
+	for i, partition := range partitions {
+		names[i] = fmt.Sprintf("%s/%d", partition.Topic, partition.Partition)
+	}
+	return strings.Join(names, ", ")
+}
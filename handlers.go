@@ -1,28 +1,211 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"github.com/segmentio/kafka-go"
 )
 
+// HandlerFunc is the signature of a message handler. It returns an error when
+// the message could not be processed, or ErrSkipMessage for a message it
+// deliberately ignores. ctx carries the consumer's handler_timeout as its
+// deadline. Handlers must honour it and pass it to the calls they make to
+// other systems: a call still running at the deadline is abandoned but keeps
+// its goroutine until it returns.
+type HandlerFunc func(
+    ctx context.Context,
+    message kafka.Message,
+    config ConsumerConfig,
+    logFunc func(level string, msg string, args ...interface{}),
+    deps HandlerDeps,
+) error
+
+// HandlerDeps holds what a handler uses besides the message: the environment's
+// sink settings and the shared producer for publishing derived messages.
+// Commit is set only for consumers with the manual commit strategy; handlers
+// pass it the messages whose processing is complete.
+type HandlerDeps struct {
+    Redis    RedisConfig
+    Mongo    MongoConfig
+    MySQL    MySQLConfig
+    Producer *Producer
+    Commit   func(messages ...kafka.Message)
+}
+
+// ErrSkipMessage is returned by a handler for a message it does not process
+var ErrSkipMessage = errors.New("message skipped")
+
+// TransformFunc is the signature of a forwarding handler. It returns the
+// messages to write to the consumer's forward topic for one source message;
+// their Topic is ignored. The output must be the same every time a message is
+// transformed, so that outputs written before a crash are recognised.
+type TransformFunc func(
+    ctx context.Context,
+    message kafka.Message,
+    config ConsumerConfig,
+    logFunc func(level string, msg string, args ...interface{}),
+) ([]kafka.Message, error)
+
+// TopicPartition identifies a partition of a topic
+type TopicPartition struct {
+    Topic     string
+    Partition int
+}
+
+// PartitionHookFunc is the signature of the OnAssigned and OnRevoked hooks of
+// a handler. Hooks never run at the same time as the handler: OnAssigned runs
+// before the first message of a generation, OnRevoked after its last message
+// and before its offsets are committed.
+type PartitionHookFunc func(
+    partitions []TopicPartition,
+    config ConsumerConfig,
+    logFunc func(level string, msg string, args ...interface{}),
+    deps HandlerDeps,
+)
+
+// HandlerSpec registers a handler together with the schema of the settings it
+// accepts. Forwarding handlers set Transform instead of Handle. Handlers that
+// keep state per partition set OnAssigned and OnRevoked.
+type HandlerSpec struct {
+    Handle     HandlerFunc
+    Transform  TransformFunc
+    Settings   SettingsSchema
+    OnAssigned PartitionHookFunc
+    OnRevoked  PartitionHookFunc
+}
+
+// handlerRegistry maps the handler_name used in the config to its implementation
+var handlerRegistry = map[string]HandlerSpec{
+    "handler1": {
+        Handle: handler1,
+        Settings: SettingsSchema{
+            "mappings": {Type: "object", Fields: SettingsSchema{
+                "code":        {Type: "string"},
+                "replacewith": {Type: "string"},
+            }},
+            "lab_codes": {Type: "object", Fields: SettingsSchema{
+                "ignore": {Type: "array", Items: &SettingSpec{Type: "string"}},
+                "rules": {Type: "array", Items: &SettingSpec{Type: "object", Fields: SettingsSchema{
+                    "name":   {Type: "string", Required: true},
+                    "action": {Type: "string", Required: true},
+                }}},
+            }},
+        },
+    },
+    "handler2": {
+        Handle:   handler2,
+        Settings: SettingsSchema{},
+    },
+    "passthrough": {
+        Transform: passthrough,
+        Settings:  SettingsSchema{},
+    },
+}
+
+// newMessageHandler binds the consumer's handler, or each of its routes or
+// handlers, to its dependencies. For a forwarding handler it returns a forwarder writing to the
+// forward topic through deps.Producer, with dedup set to skip messages already
+// forwarded; close releases its connections.
+func newMessageHandler(config ConsumerConfig, deps HandlerDeps, dedup bool) (handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error, close func() error, err error) {
+    if len(config.Routes) > 0 {
+        return newRouter(config, deps, dedup)
+    }
+    if len(config.Handlers) > 0 {
+        return newFanOut(config, deps, dedup)
+    }
+
+    spec := handlerRegistry[config.HandlerName]
+    if spec.Transform != nil {
+        forwarder, err := newForwarder(config, spec.Transform, deps.Producer, dedup)
+        if err != nil {
+            return nil, nil, err
+        }
+        return forwarder.Handle, forwarder.Close, nil
+    }
+
+    handle = func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+        return spec.Handle(ctx, message, config, logFunc, deps)
+    }
+    return handle, func() error { return nil }, nil
+}
+
+// withHandler returns the consumer config as seen by one of its routes or
+// handlers: bound to a single handler with its own settings
+func (c ConsumerConfig) withHandler(handlerName string, settings map[string]interface{}) ConsumerConfig {
+    c.Routes = nil
+    c.Handlers = nil
+    c.HandlerName = handlerName
+    c.Settings = settings
+    return c
+}
+
+// partitionHooks calls the partition hooks of every handler a consumer uses
+type partitionHooks struct {
+    deps     HandlerDeps
+    handlers []ConsumerConfig
+}
+
+func newPartitionHooks(config ConsumerConfig, deps HandlerDeps) partitionHooks {
+    hooks := partitionHooks{deps: deps}
+    switch {
+    case len(config.Routes) > 0:
+        for _, route := range consumerRoutes(config) {
+            hooks.handlers = append(hooks.handlers, config.withHandler(route.HandlerName, route.Settings))
+        }
+    case len(config.Handlers) > 0:
+        for _, handler := range config.Handlers {
+            hooks.handlers = append(hooks.handlers, config.withHandler(handler.HandlerName, handler.Settings))
+        }
+    default:
+        hooks.handlers = append(hooks.handlers, config)
+    }
+    return hooks
+}
+
+func (h partitionHooks) assigned(partitions []TopicPartition, logFunc func(level string, msg string, args ...interface{})) {
+    for _, config := range h.handlers {
+        if hook := handlerRegistry[config.HandlerName].OnAssigned; hook != nil {
+            h.call("OnAssigned", hook, partitions, config, logFunc)
+        }
+    }
+}
+
+func (h partitionHooks) revoked(partitions []TopicPartition, logFunc func(level string, msg string, args ...interface{})) {
+    for _, config := range h.handlers {
+        if hook := handlerRegistry[config.HandlerName].OnRevoked; hook != nil {
+            h.call("OnRevoked", hook, partitions, config, logFunc)
+        }
+    }
+}
+
+// call runs one hook; a panic in it is logged and the remaining hooks still run
+func (h partitionHooks) call(name string, hook PartitionHookFunc, partitions []TopicPartition, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) {
+    defer func() {
+        if r := recover(); r != nil {
+            logFunc("ERROR", "%s hook of handler %s panicked: %v\n%s", name, config.HandlerName, r, debug.Stack())
+        }
+    }()
+    hook(partitions, config, logFunc, h.deps)
+}
+
 // Define custom handler functions for each consumer
 func handler1 (
+    ctx context.Context,
     message kafka.Message,
     config ConsumerConfig,
     logFunc func(level string, msg string, args ...interface{}),
-    redisConfig RedisConfig,
-    mongoConfig MongoConfig,
-    mysqlConfig MySQLConfig,
-) {
-    logFunc("INFO", "Handler1 processing message with topic: %s", config.Topic)
+    deps HandlerDeps,
+) error {
+    logFunc("INFO", "Handler1 processing message with topic: %s", message.Topic)
     logFunc("DEBUG", "Handler1 processing message with settings: %+v", config.Settings)
     
     var data map[string]interface{}
     err := json.Unmarshal(message.Value, &data)
     if err != nil {
-        logFunc("ERROR", "Failed to unmarshal message: %v", err)
-        return
+        return fmt.Errorf("failed to unmarshal message: %w", err)
     }
 
     if name, ok := data["name"]; ok && name == "" {
@@ -53,21 +236,32 @@ func handler1 (
     }
 
     fmt.Printf("Consumer - %s: %s\n", data["name"], data["description"])
-    logFunc("INFO", "Successfully processed message from topic: %s", config.Topic)
+    logFunc("INFO", "Successfully processed message from topic: %s", message.Topic)
+    return nil
 }
 
 func handler2 (
+    ctx context.Context,
     message kafka.Message,
     config ConsumerConfig,
     logFunc func(level string, msg string, args ...interface{}),
-    redisConfig RedisConfig,
-    mongoConfig MongoConfig,
-    mysqlConfig MySQLConfig,
-) {
-    logFunc("INFO", "Handler2 processing message with topic: %s", config.Topic)
-    logFunc("INFO", "Redis Host: %s, Port: %d", redisConfig.Host, redisConfig.Port)
-    logFunc("INFO", "Mongo Server: %s, Port: %d", mongoConfig.Server, mongoConfig.Port)
-    logFunc("INFO", "MySQL Host: %s, Port: %d", mysqlConfig.Host, mysqlConfig.Port)
+    deps HandlerDeps,
+) error {
+    logFunc("INFO", "Handler2 processing message with topic: %s", message.Topic)
+    logFunc("INFO", "Redis Host: %s, Port: %d", deps.Redis.Host, deps.Redis.Port)
+    logFunc("INFO", "Mongo Server: %s, Port: %d", deps.Mongo.Server, deps.Mongo.Port)
+    logFunc("INFO", "MySQL Host: %s, Port: %d", deps.MySQL.Host, deps.MySQL.Port)
 
     fmt.Printf("Consumer received message: %s\n", string(message.Value))
+    return nil
+}
+
+// passthrough forwards every message unchanged
+func passthrough(
+    ctx context.Context,
+    message kafka.Message,
+    config ConsumerConfig,
+    logFunc func(level string, msg string, args ...interface{}),
+) ([]kafka.Message, error) {
+    return []kafka.Message{{Key: message.Key, Value: message.Value, Headers: message.Headers}}, nil
 }
@@ -0,0 +1,60 @@
+package main
+
+import "sync"
+
+// Health statuses, from best to worst
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+// health holds the checks reported by the admin /health endpoint, which tells
+// whether the process works and may back a liveness probe
+var health = &healthRegistry{checks: make(map[string]map[string]func() healthStatus)}
+
+// readiness holds the checks reported by the admin /ready endpoint: states
+// such as consumer lag that a restart would not fix, and would make worse
+var readiness = &healthRegistry{checks: make(map[string]map[string]func() healthStatus)}
+
+// healthStatus is the state of one component, e.g. one circuit breaker
+type healthStatus struct {
+	Status  string                 `json:"status"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// healthRegistry groups health checks by section, such as "circuit_breakers"
+type healthRegistry struct {
+	mu     sync.Mutex
+	checks map[string]map[string]func() healthStatus
+}
+
+func (r *healthRegistry) register(section, name string, check func() healthStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checks[section] == nil {
+		r.checks[section] = make(map[string]func() healthStatus)
+	}
+	r.checks[section][name] = check
+}
+
+// report runs every check and returns the overall status, the worst of them,
+// with the body of the /health response
+func (r *healthRegistry) report() (string, map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	overall := healthOK
+	body := make(map[string]interface{})
+	for section, checks := range r.checks {
+		statuses := make(map[string]healthStatus)
+		for name, check := range checks {
+			status := check()
+			if status.Status != healthOK {
+				overall = healthDegraded
+			}
+			statuses[name] = status
+		}
+		body[section] = statuses
+	}
+	body["status"] = overall
+	return overall, body
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// newDialer builds the dialer used for every broker connection of a consumer
+// from its resolved security settings
+func newDialer(config KafkaConfig) (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+	}
+
+	if config.Security.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(config.Security.TLS)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLS = tlsConfig
+	}
+
+	if config.Security.SASL.Mechanism != "" {
+		mechanism, err := newSASLMechanism(config.Security.SASL)
+		if err != nil {
+			return nil, err
+		}
+		dialer.SASLMechanism = mechanism
+	}
+
+	return dialer, nil
+}
+
+// newClient builds a client for metadata and offset requests against the
+// brokers, using the same security settings as the consumer's dialer
+func newClient(config KafkaConfig) (*kafka.Client, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Client{
+		Addr:      kafka.TCP(config.Brokers...),
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// closeClient closes the idle broker connections of a client built by newClient
+func closeClient(client *kafka.Client) {
+	if transport, ok := client.Transport.(*kafka.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// newTransport builds the transport shared by clients and writers from the
+// resolved security settings
+func newTransport(config KafkaConfig) (*kafka.Transport, error) {
+	transport := &kafka.Transport{
+		DialTimeout: 10 * time.Second,
+	}
+
+	if config.Security.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(config.Security.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+
+	if config.Security.SASL.Mechanism != "" {
+		mechanism, err := newSASLMechanism(config.Security.SASL)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	return transport, nil
+}
+
+// isolationLevels maps the isolation_level setting to kafka-go
+var isolationLevels = map[string]kafka.IsolationLevel{
+	"":                 kafka.ReadUncommitted,
+	"read_uncommitted": kafka.ReadUncommitted,
+	"read_committed":   kafka.ReadCommitted,
+}
+
+// groupBalancers maps the group_balancers setting to kafka-go; rack is the
+// consumer's rack for rack affinity
+var groupBalancers = map[string]func(rack string) kafka.GroupBalancer{
+	"range":         func(string) kafka.GroupBalancer { return kafka.RangeGroupBalancer{} },
+	"round_robin":   func(string) kafka.GroupBalancer { return kafka.RoundRobinGroupBalancer{} },
+	"rack_affinity": func(rack string) kafka.GroupBalancer { return kafka.RackAffinityGroupBalancer{Rack: rack} },
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newSASLMechanism(config SASLConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(config.Mechanism) {
+	case "plain":
+		return plain.Mechanism{Username: config.Username, Password: config.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, config.Username, config.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, config.Username, config.Password)
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism: %s", config.Mechanism)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const defaultLagInterval = 30 * time.Second
+
+// Lag levels, from best to worst
+const (
+	lagOK       = "ok"
+	lagWarning  = "warning"
+	lagCritical = "critical"
+)
+
+var lagLevelValues = map[string]float64{lagOK: 0, lagWarning: 1, lagCritical: 2}
+
+var (
+	lagMessages = metrics.gauge("multiconsumer_lag_messages", "Messages between the committed offset and the high watermark per assigned partition.", "consumer", "topic", "partition")
+	lagSeconds  = metrics.gauge("multiconsumer_lag_seconds", "Age of the oldest uncommitted message per assigned partition.", "consumer", "topic", "partition")
+	lagLevel    = metrics.gauge("multiconsumer_lag_level", "Lag threshold reached per assigned partition: 0 ok, 1 warning, 2 critical.", "consumer", "topic", "partition")
+)
+
+// errLagSampled stops readRange once the oldest uncommitted message was read
+var errLagSampled = errors.New("lag sampled")
+
+// partitionLag is the lag of one partition at the last measurement
+type partitionLag struct {
+	Messages int64   `json:"messages"`
+	Seconds  float64 `json:"seconds"`
+	Level    string  `json:"level"`
+}
+
+// level returns the highest threshold the lag reached
+func (c LagConfig) level(lag partitionLag) string {
+	switch {
+	case c.CriticalMessages > 0 && lag.Messages >= c.CriticalMessages,
+		c.CriticalTime > 0 && lag.Seconds >= time.Duration(c.CriticalTime).Seconds():
+		return lagCritical
+	case c.WarningMessages > 0 && lag.Messages >= c.WarningMessages,
+		c.WarningTime > 0 && lag.Seconds >= time.Duration(c.WarningTime).Seconds():
+		return lagWarning
+	default:
+		return lagOK
+	}
+}
+
+// lagMonitor periodically measures the lag of the partitions assigned to the
+// consumer: the committed offsets of its group against the high watermarks,
+// and the age of the oldest message not committed yet. A partition without a
+// committed offset is measured from where the consumer starts reading it: the
+// log start for the "earliest" start offset, or for "latest" the high
+// watermark found by its first measurement.
+type lagMonitor struct {
+	consumer string
+	groupID  string
+	kafka    KafkaConfig
+	config   LagConfig
+	latest   bool
+	interval time.Duration
+	client   *kafka.Client
+	dialer   *kafka.Dialer
+	logger   func(level string, msg string, args ...interface{})
+
+	mu         sync.Mutex
+	partitions []TopicPartition
+	starts     map[TopicPartition]int64
+	lags       map[TopicPartition]partitionLag
+	failing    bool
+}
+
+func newLagMonitor(config ConsumerConfig, client *kafka.Client, dialer *kafka.Dialer, logger func(level string, msg string, args ...interface{})) *lagMonitor {
+	m := &lagMonitor{
+		consumer: config.Name,
+		groupID:  config.GroupID,
+		kafka:    config.KafkaConfig,
+		latest:   config.StartOffset.readerStartOffset() == kafka.LastOffset,
+		interval: defaultLagInterval,
+		client:   client,
+		dialer:   dialer,
+		logger:   logger,
+		starts:   make(map[TopicPartition]int64),
+		lags:     make(map[TopicPartition]partitionLag),
+	}
+	if config.Lag != nil {
+		m.config = *config.Lag
+		if config.Lag.Interval > 0 {
+			m.interval = time.Duration(config.Lag.Interval)
+		}
+	}
+	readiness.register("lag", config.Name, m.health)
+	return m
+}
+
+// assign sets the partitions to measure and drops the lag of the others
+func (m *lagMonitor) assign(partitions []TopicPartition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partitions = partitions
+	assigned := make(map[TopicPartition]bool)
+	for _, partition := range partitions {
+		assigned[partition] = true
+	}
+	for partition := range m.starts {
+		if !assigned[partition] {
+			delete(m.starts, partition)
+		}
+	}
+	for partition := range m.lags {
+		if !assigned[partition] {
+			delete(m.lags, partition)
+			labels := []string{m.consumer, partition.Topic, strconv.Itoa(partition.Partition)}
+			lagMessages.Delete(labels...)
+			lagSeconds.Delete(labels...)
+			lagLevel.Delete(labels...)
+		}
+	}
+}
+
+// run measures the lag every interval until ctx ends
+func (m *lagMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.measure(ctx); err != nil && ctx.Err() == nil {
+				if !m.failing {
+					m.logger("WARNING", "Failed to measure consumer lag: %v", err)
+				}
+				m.failing = true
+			} else {
+				m.failing = false
+			}
+		}
+	}
+}
+
+func (m *lagMonitor) measure(ctx context.Context) error {
+	m.mu.Lock()
+	partitions := m.partitions
+	m.mu.Unlock()
+	if len(partitions) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+	byTopic := make(map[string][]int)
+	for _, partition := range partitions {
+		byTopic[partition.Topic] = append(byTopic[partition.Topic], partition.Partition)
+	}
+	committed, err := fetchCommittedOffsets(ctx, m.client, m.groupID, byTopic)
+	if err != nil {
+		return err
+	}
+	marks, err := fetchWatermarks(ctx, m.client, byTopic)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		mark := marks[partition.Topic][partition.Partition]
+		offset, ok := committed.get(partition.Topic, partition.Partition)
+		if !ok || offset < 0 {
+			offset = m.startOffset(partition, mark)
+		}
+		start := max(offset, mark.First)
+		lag := partitionLag{Messages: max(0, mark.Last-start)}
+		if lag.Messages > 0 {
+			produced, err := m.oldestMessageTime(ctx, partition, start, mark.Last)
+			if err != nil {
+				return fmt.Errorf("failed to read %s/%d@%d: %w", partition.Topic, partition.Partition, start, err)
+			}
+			if !produced.IsZero() {
+				lag.Seconds = max(0, time.Since(produced).Seconds())
+			}
+		}
+		lag.Level = m.config.level(lag)
+		m.update(partition, lag)
+	}
+	return nil
+}
+
+// startOffset returns where the consumer starts reading a partition that has
+// no committed offset yet
+func (m *lagMonitor) startOffset(partition TopicPartition, mark watermarks) int64 {
+	if !m.latest {
+		return mark.First
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if start, ok := m.starts[partition]; ok {
+		return start
+	}
+	for _, p := range m.partitions {
+		if p == partition {
+			m.starts[partition] = mark.Last
+		}
+	}
+	return mark.Last
+}
+
+// oldestMessageTime returns the timestamp of the first message in [start, end),
+// or the zero time when there is none
+func (m *lagMonitor) oldestMessageTime(ctx context.Context, partition TopicPartition, start, end int64) (time.Time, error) {
+	var produced time.Time
+	err := readRange(ctx, m.kafka, m.dialer, partition.Topic, partition.Partition, start, end, func(message kafka.Message) error {
+		produced = message.Time
+		return errLagSampled
+	})
+	// Only transaction markers or compacted offsets are left; nothing is waiting
+	if errors.Is(err, errLagSampled) || errors.Is(err, errRangeIdle) {
+		err = nil
+	}
+	return produced, err
+}
+
+// update records the lag of a partition and logs when it crosses a threshold
+func (m *lagMonitor) update(partition TopicPartition, lag partitionLag) {
+	m.mu.Lock()
+	assigned := false
+	for _, p := range m.partitions {
+		assigned = assigned || p == partition
+	}
+	if !assigned {
+		m.mu.Unlock()
+		return // Revoked while it was measured
+	}
+	previous, measured := m.lags[partition]
+	m.lags[partition] = lag
+	m.mu.Unlock()
+
+	labels := []string{m.consumer, partition.Topic, strconv.Itoa(partition.Partition)}
+	lagMessages.Set(float64(lag.Messages), labels...)
+	lagSeconds.Set(lag.Seconds, labels...)
+	lagLevel.Set(lagLevelValues[lag.Level], labels...)
+
+	if !measured {
+		previous.Level = lagOK
+	}
+	if lag.Level == previous.Level {
+		return
+	}
+	behind := time.Duration(lag.Seconds * float64(time.Second)).Round(time.Second).String()
+	switch {
+	case lagLevelValues[lag.Level] > lagLevelValues[previous.Level]:
+		level := "WARNING"
+		if lag.Level == lagCritical {
+			level = "ERROR"
+		}
+		m.logger(level, "Lag of %s/%d reached the %s threshold: %d messages, %s behind head", partition.Topic, partition.Partition, lag.Level, lag.Messages, behind)
+	case lag.Level == lagOK:
+		m.logger("INFO", "Lag of %s/%d is back below the thresholds: %d messages, %s behind head", partition.Topic, partition.Partition, lag.Messages, behind)
+	default:
+		m.logger("INFO", "Lag of %s/%d dropped back to the %s threshold: %d messages, %s behind head", partition.Topic, partition.Partition, lag.Level, lag.Messages, behind)
+	}
+}
+
+// health reports the consumer as degraded while any partition is at the
+// critical threshold, and lists the partitions at or above the warning one. It
+// is a readiness check: restarting a consumer that lags does not help it.
+func (m *lagMonitor) health() healthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := healthStatus{Status: healthOK}
+	var maxMessages int64
+	var maxSeconds float64
+	lagging := make(map[string]partitionLag)
+	for partition, lag := range m.lags {
+		maxMessages = max(maxMessages, lag.Messages)
+		maxSeconds = max(maxSeconds, lag.Seconds)
+		if lag.Level != lagOK {
+			lagging[fmt.Sprintf("%s/%d", partition.Topic, partition.Partition)] = lag
+		}
+		if lag.Level == lagCritical {
+			status.Status = healthDegraded
+		}
+	}
+	status.Details = map[string]interface{}{"max_messages": maxMessages, "max_seconds": maxSeconds}
+	if len(lagging) > 0 {
+		status.Details["partitions"] = lagging
+	}
+	return status
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLagConfigLevel(t *testing.T) {
+	config := LagConfig{
+		WarningMessages:  100,
+		CriticalMessages: 1000,
+		WarningTime:      Duration(time.Minute),
+		CriticalTime:     Duration(10 * time.Minute),
+	}
+	tests := []struct {
+		name   string
+		config LagConfig
+		lag    partitionLag
+		want   string
+	}{
+		{name: "below both", config: config, lag: partitionLag{Messages: 99, Seconds: 59}, want: lagOK},
+		{name: "warning by messages", config: config, lag: partitionLag{Messages: 100}, want: lagWarning},
+		{name: "warning by time", config: config, lag: partitionLag{Messages: 1, Seconds: 60}, want: lagWarning},
+		{name: "critical by messages", config: config, lag: partitionLag{Messages: 1000, Seconds: 1}, want: lagCritical},
+		{name: "critical by time", config: config, lag: partitionLag{Messages: 1, Seconds: 600}, want: lagCritical},
+		{name: "thresholds off", config: LagConfig{}, lag: partitionLag{Messages: 1e9, Seconds: 1e6}, want: lagOK},
+		{name: "only a critical time", config: LagConfig{CriticalTime: Duration(time.Minute)}, lag: partitionLag{Messages: 1e9, Seconds: 30}, want: lagOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.level(tt.lag); got != tt.want {
+				t.Errorf("level(%+v) = %s, want %s", tt.lag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLagMonitorUpdate(t *testing.T) {
+	partition := TopicPartition{Topic: "orders", Partition: 3}
+	steps := []struct {
+		level  string
+		logged string // text of the logged message, empty for none
+		health string
+	}{
+		{level: lagOK, health: healthOK},
+		{level: lagWarning, logged: "WARNING: Lag of orders/3 reached the warning threshold", health: healthOK},
+		{level: lagWarning, health: healthOK},
+		{level: lagCritical, logged: "ERROR: Lag of orders/3 reached the critical threshold", health: healthDegraded},
+		{level: lagWarning, logged: "INFO: Lag of orders/3 dropped back to the warning threshold", health: healthOK},
+		{level: lagOK, logged: "INFO: Lag of orders/3 is back below the thresholds", health: healthOK},
+	}
+
+	logs := &logRecorder{}
+	m := newLagMonitor(ConsumerConfig{Name: "test-lag"}, nil, nil, logs.log)
+	m.assign([]TopicPartition{partition})
+	for i, step := range steps {
+		before := len(logs.messages)
+		m.update(partition, partitionLag{Messages: 10, Level: step.level})
+
+		logged := logs.messages[before:]
+		switch {
+		case step.logged == "" && len(logged) > 0:
+			t.Errorf("step %d: logged %q, want nothing", i, logged)
+		case step.logged != "" && (len(logged) != 1 || logs.count(step.logged) != 1):
+			t.Errorf("step %d: logged %q, want %q", i, logged, step.logged)
+		}
+		if got := m.health().Status; got != step.health {
+			t.Errorf("step %d: health = %s, want %s", i, got, step.health)
+		}
+	}
+
+	// A partition revoked while it was measured is not recorded
+	m.assign(nil)
+	m.update(partition, partitionLag{Messages: 5000, Level: lagCritical})
+	if len(m.lags) != 0 {
+		t.Errorf("lags = %v after the partition was revoked, want none", m.lags)
+	}
+}
+
+func TestLagIsReportedOnReadiness(t *testing.T) {
+	partition := TopicPartition{Topic: "orders", Partition: 0}
+	m := newLagMonitor(ConsumerConfig{Name: "test-readiness"}, nil, nil, discardLog)
+	m.assign([]TopicPartition{partition})
+	m.update(partition, partitionLag{Messages: 5000, Level: lagCritical})
+	defer m.assign(nil)
+
+	if status, _ := readiness.report(); status != healthDegraded {
+		t.Errorf("readiness = %s, want %s", status, healthDegraded)
+	}
+	_, body := health.report()
+	if _, ok := body["lag"]; ok {
+		t.Error("/health reports the lag, which would fail liveness probes during a backlog")
+	}
+}
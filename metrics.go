@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics holds every metric of the process; the admin listener serves it at
+// /metrics in the Prometheus text format
+var metrics = &metricRegistry{byName: make(map[string]*metric)}
+
+// metricRegistry is a minimal set of labelled counters and gauges
+type metricRegistry struct {
+	mu      sync.Mutex
+	byName  map[string]*metric
+	ordered []*metric
+}
+
+// metric is a counter or gauge with one value per combination of label values
+type metric struct {
+	registry *metricRegistry
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	values   map[string]float64
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metric {
+	return r.register(name, help, "counter", labels)
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metric {
+	return r.register(name, help, "gauge", labels)
+}
+
+func (r *metricRegistry) register(name, help, kind string, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[name]; ok {
+		panic("metric registered twice: " + name)
+	}
+	m := &metric{registry: r, name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	r.byName[name] = m
+	r.ordered = append(r.ordered, m)
+	return m
+}
+
+// Add increases the value for the given label values, in the order the labels
+// were registered
+func (m *metric) Add(delta float64, labelValues ...string) {
+	m.registry.mu.Lock()
+	defer m.registry.mu.Unlock()
+	m.values[m.key(labelValues)] += delta
+}
+
+// Inc increases the value for the given label values by one
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set replaces the value for the given label values
+func (m *metric) Set(value float64, labelValues ...string) {
+	m.registry.mu.Lock()
+	defer m.registry.mu.Unlock()
+	m.values[m.key(labelValues)] = value
+}
+
+// Delete drops the value for the given label values, e.g. for a partition that
+// is no longer assigned
+func (m *metric) Delete(labelValues ...string) {
+	m.registry.mu.Lock()
+	defer m.registry.mu.Unlock()
+	delete(m.values, m.key(labelValues))
+}
+
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (r *metricRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range r.ordered {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.WriteString(m.name)
+			if len(m.labels) > 0 {
+				b.WriteByte('{')
+				for i, value := range strings.Split(key, "\xff") {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=%s", m.labels[i], strconv.Quote(value))
+				}
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(m.values[key], 'g', -1, 64))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
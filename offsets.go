@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// StartOffset selects where a consumer group starts reading partitions that
+// have no committed offset yet. In JSON it is "earliest", "latest", an RFC 3339
+// timestamp, or an object of explicit offsets keyed by topic and partition,
+// e.g. {"countries": {"0": 640, "1": 12}}.
+type StartOffset struct {
+	Position   string
+	Time       time.Time
+	Partitions map[string]map[int]int64
+}
+
+func (s StartOffset) MarshalJSON() ([]byte, error) {
+	switch {
+	case s.Partitions != nil:
+		return json.Marshal(s.Partitions)
+	case !s.Time.IsZero():
+		return json.Marshal(s.Time.Format(time.RFC3339Nano))
+	case s.Position != "":
+		return json.Marshal(s.Position)
+	default:
+		return []byte("null"), nil
+	}
+}
+
+func (s *StartOffset) UnmarshalJSON(data []byte) error {
+	*s = StartOffset{}
+	if string(data) == "null" {
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		switch strings.ToLower(text) {
+		case "", "earliest", "latest":
+			s.Position = strings.ToLower(text)
+			return nil
+		}
+		at, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return fmt.Errorf("invalid start_offset %q: expected earliest, latest or an RFC 3339 timestamp", text)
+		}
+		s.Time = at
+		return nil
+	}
+
+	if err := json.Unmarshal(data, &s.Partitions); err != nil {
+		return fmt.Errorf("invalid start_offset: expected a string or offsets by topic and partition: %w", err)
+	}
+	return nil
+}
+
+// readerStartOffset returns the kafka-go start offset used for partitions
+// without a committed offset when no explicit offsets are set
+func (s StartOffset) readerStartOffset() int64 {
+	if s.Position == "latest" {
+		return kafka.LastOffset
+	}
+	return kafka.FirstOffset
+}
+
+// needsCommit reports whether the start offset has to be committed for the
+// group before it starts, as kafka-go only knows earliest and latest
+func (s StartOffset) needsCommit() bool {
+	return !s.Time.IsZero() || s.Partitions != nil
+}
+
+// partitionOffsets maps topic and partition to an offset
+type partitionOffsets map[string]map[int]int64
+
+func (p partitionOffsets) set(topic string, partition int, offset int64) {
+	if p[topic] == nil {
+		p[topic] = make(map[int]int64)
+	}
+	p[topic][partition] = offset
+}
+
+func (p partitionOffsets) get(topic string, partition int) (int64, bool) {
+	offset, ok := p[topic][partition]
+	return offset, ok
+}
+
+// topicPartitions looks up the partitions of each topic
+func topicPartitions(ctx context.Context, client *kafka.Client, topics []string) (map[string][]int, error) {
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[string][]int)
+	for _, topic := range metadata.Topics {
+		if topic.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Name, topic.Error)
+		}
+		for _, partition := range topic.Partitions {
+			partitions[topic.Name] = append(partitions[topic.Name], partition.ID)
+		}
+		sort.Ints(partitions[topic.Name])
+	}
+	return partitions, nil
+}
+
+// fetchCommittedOffsets returns the group's committed offset for each
+// partition, or -1 where nothing is committed
+func fetchCommittedOffsets(ctx context.Context, client *kafka.Client, groupID string, partitions map[string][]int) (partitionOffsets, error) {
+	response, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: groupID, Topics: partitions})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != nil {
+		return nil, response.Error
+	}
+	offsets := make(partitionOffsets)
+	for topic, fetched := range response.Topics {
+		for _, partition := range fetched {
+			if partition.Error != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w", topic, partition.Partition, partition.Error)
+			}
+			offsets.set(topic, partition.Partition, partition.CommittedOffset)
+		}
+	}
+	return offsets, nil
+}
+
+// watermarks holds the first available offset and the log end offset of a partition
+type watermarks struct {
+	First int64
+	Last  int64
+}
+
+// fetchWatermarks returns the first and log end offset of each partition
+func fetchWatermarks(ctx context.Context, client *kafka.Client, partitions map[string][]int) (map[string]map[int]watermarks, error) {
+	request := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	for topic, ids := range partitions {
+		for _, id := range ids {
+			request.Topics[topic] = append(request.Topics[topic], kafka.FirstOffsetOf(id), kafka.LastOffsetOf(id))
+		}
+	}
+	response, err := client.ListOffsets(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[int]watermarks)
+	for topic, listed := range response.Topics {
+		result[topic] = make(map[int]watermarks)
+		for _, partition := range listed {
+			if partition.Error != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w", topic, partition.Partition, partition.Error)
+			}
+			result[topic][partition.Partition] = watermarks{First: partition.FirstOffset, Last: partition.LastOffset}
+		}
+	}
+	return result, nil
+}
+
+// fetchOffsetsForTime returns, for each partition, the first offset whose
+// message timestamp is at or after at, or -1 when there is none
+func fetchOffsetsForTime(ctx context.Context, client *kafka.Client, partitions map[string][]int, at time.Time) (partitionOffsets, error) {
+	request := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	for topic, ids := range partitions {
+		for _, id := range ids {
+			request.Topics[topic] = append(request.Topics[topic], kafka.TimeOffsetOf(id, at))
+		}
+	}
+	response, err := client.ListOffsets(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(partitionOffsets)
+	for topic, listed := range response.Topics {
+		for _, partition := range listed {
+			if partition.Error != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w", topic, partition.Partition, partition.Error)
+			}
+			offset := int64(-1)
+			for found := range partition.Offsets {
+				offset = found
+			}
+			offsets.set(topic, partition.Partition, offset)
+		}
+	}
+	return offsets, nil
+}
+
+// commitGroupOffsets commits offsets for a group from outside the group. The
+// brokers only accept this while the group has no active members.
+func commitGroupOffsets(ctx context.Context, client *kafka.Client, groupID string, offsets partitionOffsets) error {
+	request := &kafka.OffsetCommitRequest{
+		GroupID:      groupID,
+		GenerationID: -1,
+		Topics:       make(map[string][]kafka.OffsetCommit),
+	}
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			request.Topics[topic] = append(request.Topics[topic], kafka.OffsetCommit{Partition: partition, Offset: offset})
+		}
+	}
+
+	response, err := client.OffsetCommit(ctx, request)
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range response.Topics {
+		for _, partition := range partitions {
+			if partition.Error != nil {
+				return fmt.Errorf("topic %s partition %d: %w", topic, partition.Partition, partition.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// groupState returns the state of a consumer group and its number of members
+func groupState(ctx context.Context, client *kafka.Client, groupID string) (string, int, error) {
+	response, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{groupID}})
+	if err != nil {
+		return "", 0, err
+	}
+	for _, group := range response.Groups {
+		if group.GroupID == groupID {
+			return group.GroupState, len(group.Members), group.Error
+		}
+	}
+	return "Dead", 0, nil
+}
+
+// applyStartOffset commits the configured start offset for every partition of
+// topics that the group has not committed yet, so that the group starts there
+func (kc *KafkaConsumer) applyStartOffset(topics []string) error {
+	startOffset := kc.consumerConfig.StartOffset
+	if !startOffset.needsCommit() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(kc.ctx, 30*time.Second)
+	defer cancel()
+
+	client := kc.client
+	// Running members own the group's offsets; the first member to start applies them
+	if _, members, err := groupState(ctx, client, kc.consumerConfig.GroupID); err != nil || members > 0 {
+		return err
+	}
+	partitions, err := topicPartitions(ctx, client, topics)
+	if err != nil {
+		return err
+	}
+	committed, err := fetchCommittedOffsets(ctx, client, kc.consumerConfig.GroupID, partitions)
+	if err != nil {
+		return err
+	}
+
+	var byTime partitionOffsets
+	var marks map[string]map[int]watermarks
+	if !startOffset.Time.IsZero() {
+		if byTime, err = fetchOffsetsForTime(ctx, client, partitions, startOffset.Time); err != nil {
+			return err
+		}
+		if marks, err = fetchWatermarks(ctx, client, partitions); err != nil {
+			return err
+		}
+	}
+
+	initial := make(partitionOffsets)
+	for topic, ids := range partitions {
+		for _, id := range ids {
+			if offset, ok := committed.get(topic, id); ok && offset >= 0 {
+				continue
+			}
+			if startOffset.Partitions != nil {
+				if offset, ok := startOffset.Partitions[topic][id]; ok {
+					initial.set(topic, id, offset)
+				}
+				continue
+			}
+			offset, _ := byTime.get(topic, id)
+			if offset < 0 {
+				offset = marks[topic][id].Last
+			}
+			initial.set(topic, id, offset)
+		}
+	}
+	if len(initial) == 0 {
+		return nil
+	}
+
+	if err := commitGroupOffsets(ctx, client, kc.consumerConfig.GroupID, initial); err != nil {
+		return err
+	}
+	kc.logger("INFO", "Committed start offsets for group %s: %s", kc.consumerConfig.GroupID, describeOffsets(initial))
+	return nil
+}
+
+// describeOffsets formats offsets as topic/partition=offset for log messages
+func describeOffsets(offsets partitionOffsets) string {
+	var parts []string
+	for _, topic := range sortedKeys(offsets) {
+		partitions := make([]int, 0, len(offsets[topic]))
+		for partition := range offsets[topic] {
+			partitions = append(partitions, partition)
+		}
+		sort.Ints(partitions)
+		for _, partition := range partitions {
+			parts = append(parts, topic+"/"+strconv.Itoa(partition)+"="+strconv.FormatInt(offsets[topic][partition], 10))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// describeMessage identifies a message as topic/partition@offset for log messages
+func describeMessage(message kafka.Message) string {
+	return fmt.Sprintf("%s/%d@%d", message.Topic, message.Partition, message.Offset)
+}
+
+// rangeIdleTimeout ends the read of a partition range when no message arrives
+// for this long, e.g. when the last offsets of the range were compacted away or
+// are transaction markers
+const rangeIdleTimeout = 10 * time.Second
+
+// errRangeIdle is returned by readRange when the range ended early; see rangeIdleTimeout
+var errRangeIdle = errors.New("no more messages in range")
+
+// readRange reads the offsets [start, end) of one partition without a consumer
+// group and passes each message to fn, stopping at the first error fn returns
+func readRange(ctx context.Context, config KafkaConfig, dialer *kafka.Dialer, topic string, partition int, start, end int64, fn func(kafka.Message) error) error {
+	if start >= end {
+		return nil
+	}
+
+	readerConfig := kafka.ReaderConfig{
+		Brokers:        config.Brokers,
+		Topic:          topic,
+		Partition:      partition,
+		Dialer:         dialer,
+		MinBytes:       1,
+		MaxBytes:       10e6,
+		MaxWait:        500 * time.Millisecond,
+		IsolationLevel: isolationLevels[config.IsolationLevel],
+	}
+	if config.MaxBytes > 0 {
+		readerConfig.MaxBytes = config.MaxBytes
+	}
+	reader := kafka.NewReader(readerConfig)
+	defer reader.Close()
+	if err := reader.SetOffset(start); err != nil {
+		return err
+	}
+
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, rangeIdleTimeout)
+		message, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				return errRangeIdle
+			}
+			return err
+		}
+		if message.Offset >= end {
+			return nil
+		}
+		if err := fn(message); err != nil {
+			return err
+		}
+		if message.Offset >= end-1 {
+			return nil
+		}
+	}
+}
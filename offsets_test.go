@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestStartOffsetUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		want        StartOffset
+		readerStart int64
+		needsCommit bool
+		err         string
+	}{
+		{name: "null", data: `null`, readerStart: kafka.FirstOffset},
+		{name: "earliest", data: `"earliest"`, want: StartOffset{Position: "earliest"}, readerStart: kafka.FirstOffset},
+		{name: "latest", data: `"Latest"`, want: StartOffset{Position: "latest"}, readerStart: kafka.LastOffset},
+		{
+			name:        "timestamp",
+			data:        `"2024-03-01T12:00:00Z"`,
+			want:        StartOffset{Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+			readerStart: kafka.FirstOffset,
+			needsCommit: true,
+		},
+		{
+			name:        "partitions",
+			data:        `{"countries": {"0": 640, "1": 12}}`,
+			want:        StartOffset{Partitions: map[string]map[int]int64{"countries": {0: 640, 1: 12}}},
+			readerStart: kafka.FirstOffset,
+			needsCommit: true,
+		},
+		{name: "unknown position", data: `"newest"`, err: `invalid start_offset "newest"`},
+		{name: "invalid partition", data: `{"countries": {"first": 1}}`, err: "invalid start_offset: expected a string or offsets by topic and partition"},
+		{name: "number", data: `12`, err: "invalid start_offset: expected a string or offsets by topic and partition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offset StartOffset
+			err := json.Unmarshal([]byte(tt.data), &offset)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(offset, tt.want) {
+				t.Errorf("StartOffset = %+v, want %+v", offset, tt.want)
+			}
+			if got := offset.readerStartOffset(); got != tt.readerStart {
+				t.Errorf("readerStartOffset() = %d, want %d", got, tt.readerStart)
+			}
+			if got := offset.needsCommit(); got != tt.needsCommit {
+				t.Errorf("needsCommit() = %v, want %v", got, tt.needsCommit)
+			}
+
+			data, err := json.Marshal(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded StartOffset
+			if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, offset) {
+				t.Errorf("round trip of %s = %+v, %v", data, decoded, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// overrideEnvPrefix marks the environment variables that override config fields.
+// It is long enough not to catch variables set for other programs.
+const overrideEnvPrefix = "MULTICONSUMER_"
+
+// Override sets one config field, addressed by path, to value. Source names the
+// flag or environment variable it came from, for error messages.
+type Override struct {
+	Path    string
+	Value   string
+	Source  string
+	FromEnv bool
+}
+
+// EnvOverrides collects the overrides given as MULTICONSUMER_* environment
+// variables. The variable name is the upper-cased path with "_" between keys,
+// e.g. MULTICONSUMER_KAFKACONSUMERS_0_DEBUG_MODE or
+// MULTICONSUMER_REDIS_PRODUCTION_HOST.
+func EnvOverrides(environ []string) []Override {
+	var overrides []Override
+	for _, entry := range environ {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(name, overrideEnvPrefix) || len(name) == len(overrideEnvPrefix) {
+			continue
+		}
+		overrides = append(overrides, Override{
+			Path:    strings.TrimPrefix(name, overrideEnvPrefix),
+			Value:   value,
+			Source:  name,
+			FromEnv: true,
+		})
+	}
+	return overrides
+}
+
+// SetOverrides parses repeated -set path=value flags. Paths use the JSON keys
+// separated by dots, with list entries addressed by index or by identity, e.g.
+// kafkaConsumers.0.debug_mode or kafkaConsumers[cities].debug_mode.
+func SetOverrides(values []string) ([]Override, error) {
+	var overrides []Override
+	for _, entry := range values {
+		path, value, ok := strings.Cut(entry, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("-set %s: expected path=value", entry)
+		}
+		overrides = append(overrides, Override{Path: path, Value: value, Source: "-set " + path})
+	}
+	return overrides, nil
+}
+
+// ApplyOverrides returns a copy of config with every override applied in order.
+// An environment variable that names no config field is logged and skipped,
+// while an unknown -set path is an error.
+func ApplyOverrides(config *FullConfig, overrides []Override) (*FullConfig, error) {
+	if len(overrides) == 0 {
+		return config, nil
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config data: %w", err)
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode config data: %w", err)
+	}
+
+	envKeys := make(map[string]bool)
+	for _, named := range config.envSections() {
+		envKeys[named.key] = true
+	}
+
+	for _, override := range overrides {
+		segments := splitOverridePath(override.Path)
+		if override.FromEnv {
+			segments = strings.Split(override.Path, "_")
+		}
+
+		path, target, err := matchOverridePath(reflect.TypeOf(FullConfig{}), tree, segments, override.FromEnv)
+		if err != nil && override.FromEnv {
+			log.Printf("WARNING: ignoring environment variable %s: %v\n", override.Source, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", override.Source, err)
+		}
+
+		value, err := overrideValue(override.Value, target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", override.Source, err)
+		}
+		// Secrets in environment-scoped sections are resolved with the environment
+		if key, ok := path[0].(string); !ok || !envKeys[key] {
+			value, err = resolveSecrets(value, override.Source, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if tree, err = setTreePath(tree, path, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", override.Source, err)
+		}
+	}
+
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config data: %w", err)
+	}
+	var result FullConfig
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to apply overrides: %w", err)
+	}
+	return &result, nil
+}
+
+// splitOverridePath splits a -set path such as kafkaConsumers[0].debug_mode into keys
+func splitOverridePath(path string) []string {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	return strings.Split(path, ".")
+}
+
+// listIdentityKeys are the fields that identify an entry of a list, so that
+// overrides do not depend on the entry's position
+var listIdentityKeys = []string{"name"}
+
+var (
+	envSectionType  = reflect.TypeOf((*envSection)(nil)).Elem()
+	durationType    = reflect.TypeOf(Duration(0))
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// objectUnmarshalers decode their own JSON but still read it as an object of
+// their fields, which overrides address one by one
+var objectUnmarshalers = map[reflect.Type]bool{reflect.TypeOf(ConsumerConfig{}): true}
+
+// matchOverridePath maps override segments onto a path in the config tree,
+// guided by the config types. With greedy set, several segments may join with
+// "_" to form one key, as environment variable names cannot tell the key
+// separator from an underscore within a key. It returns the tree path, whose
+// elements are map keys or list indexes, and the type of the target field.
+func matchOverridePath(t reflect.Type, node interface{}, segments []string, greedy bool) ([]interface{}, reflect.Type, error) {
+	if len(segments) == 0 {
+		return nil, t, nil
+	}
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	// candidates returns the keys that the leading segments may form, longest
+	// first, with the number of segments each one uses
+	type candidate struct {
+		key  string
+		used int
+	}
+	candidates := func() []candidate {
+		if !greedy {
+			return []candidate{{segments[0], 1}}
+		}
+		var keys []candidate
+		for n := len(segments); n > 0; n-- {
+			keys = append(keys, candidate{strings.Join(segments[:n], "_"), n})
+		}
+		return keys
+	}
+	descend := func(key interface{}, childType reflect.Type, child interface{}, used int) ([]interface{}, reflect.Type, error) {
+		rest, target, err := matchOverridePath(childType, child, segments[used:], greedy)
+		if err != nil {
+			return nil, nil, err
+		}
+		return append([]interface{}{key}, rest...), target, nil
+	}
+	nodeMap, _ := node.(map[string]interface{})
+
+	switch {
+	case t != nil && t.Implements(envSectionType):
+		valueType := reflect.Zero(t).Interface().(envSection).valueType()
+		for _, c := range candidates() {
+			for key := range nodeMap {
+				if strings.EqualFold(key, c.key) {
+					return descend(key, valueType, nodeMap[key], c.used)
+				}
+			}
+		}
+		return descend(strings.ToLower(segments[0]), valueType, nil, 1)
+
+	case t != nil && t.Kind() == reflect.Struct && (objectUnmarshalers[t] || !reflect.PointerTo(t).Implements(unmarshalerType)):
+		fields := jsonFields(t)
+		for _, c := range candidates() {
+			for name, field := range fields {
+				if strings.EqualFold(name, c.key) {
+					return descend(name, field.Type, nodeMap[name], c.used)
+				}
+			}
+		}
+		return nil, nil, fmt.Errorf("unknown config field %q", segments[0])
+
+	case t != nil && t.Kind() == reflect.Slice, (t == nil || t.Kind() == reflect.Interface) && isList(node):
+		var elemType reflect.Type
+		if t != nil {
+			elemType = t.Elem()
+		}
+		items, _ := node.([]interface{})
+		if index, err := strconv.Atoi(segments[0]); err == nil {
+			if index < 0 || index >= len(items) {
+				return nil, nil, fmt.Errorf("index %d out of range", index)
+			}
+			return descend(index, elemType, items[index], 1)
+		}
+		for _, c := range candidates() {
+			for index, item := range items {
+				entry, _ := item.(map[string]interface{})
+				for _, identity := range listIdentityKeys {
+					if value, ok := entry[identity].(string); ok && strings.EqualFold(value, c.key) {
+						return descend(index, elemType, item, c.used)
+					}
+				}
+			}
+		}
+		return nil, nil, fmt.Errorf("no list entry matches %q", segments[0])
+
+	case t != nil && t.Kind() == reflect.Map, t == nil || t.Kind() == reflect.Interface:
+		var elemType reflect.Type
+		if t != nil && t.Kind() == reflect.Map {
+			elemType = t.Elem()
+		}
+		for _, c := range candidates() {
+			for key := range nodeMap {
+				if strings.EqualFold(key, c.key) {
+					return descend(key, elemType, nodeMap[key], c.used)
+				}
+			}
+		}
+		// A new key in a free-form map takes all remaining segments
+		if greedy && (elemType == nil || elemType.Kind() == reflect.Interface) {
+			return []interface{}{strings.ToLower(strings.Join(segments, "_"))}, elemType, nil
+		}
+		key := segments[0]
+		if greedy {
+			key = strings.ToLower(key)
+		}
+		return descend(key, elemType, nil, 1)
+
+	default:
+		return nil, nil, fmt.Errorf("%s is not an object", segments[0])
+	}
+}
+
+func isList(node interface{}) bool {
+	_, ok := node.([]interface{})
+	return ok
+}
+
+// jsonFields returns the fields of a struct type by JSON key, including the
+// fields of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Tag.Get("json") == "" && field.Type.Kind() == reflect.Struct {
+			for name, inner := range jsonFields(field.Type) {
+				fields[name] = inner
+			}
+			continue
+		}
+		fields[jsonName(field)] = field
+	}
+	return fields
+}
+
+// overrideValue converts the raw override text into a JSON value for the target
+// type. Strings are taken literally; anything else is parsed as JSON, falling
+// back to a string for free-form values.
+func overrideValue(raw string, target reflect.Type) (interface{}, error) {
+	if target != nil && (target.Kind() == reflect.String || target == durationType) {
+		return raw, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		// Free-form values and types with their own JSON decoding also accept plain text
+		if target == nil || target.Kind() == reflect.Interface || reflect.PointerTo(target).Implements(unmarshalerType) {
+			return raw, nil
+		}
+		return nil, fmt.Errorf("invalid value %q for a %s field", raw, target.Kind())
+	}
+	return value, nil
+}
+
+// setTreePath sets value at path in a decoded JSON tree, creating objects as needed
+func setTreePath(node interface{}, path []interface{}, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch key := path[0].(type) {
+	case int:
+		items, ok := node.([]interface{})
+		if !ok || key >= len(items) {
+			return nil, fmt.Errorf("index %d out of range", key)
+		}
+		child, err := setTreePath(items[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		items[key] = child
+		return items, nil
+	default:
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			object = make(map[string]interface{})
+		}
+		child, err := setTreePath(object[key.(string)], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[key.(string)] = child
+		return object, nil
+	}
+}
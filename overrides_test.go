@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const overrideTestConfig = `{
+	"redis": {"production": {"host": "redis.internal", "port": 6379}},
+	"kafkaConsumers": [
+		{"name": "cities", "topic": "cities", "group_id": "cities-group", "debug_mode": false, "settings": {"batch_size": 10}},
+		{"name": "countries", "topic": "countries", "group_id": "countries-group"}
+	]
+}`
+
+func TestMatchOverridePath(t *testing.T) {
+	var tree interface{}
+	if err := json.Unmarshal([]byte(overrideTestConfig), &tree); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		segments []string
+		greedy   bool
+		path     []interface{}
+		kind     reflect.Kind
+		err      string
+	}{
+		{name: "list index", segments: []string{"kafkaConsumers", "0", "debug_mode"}, path: []interface{}{"kafkaConsumers", 0, "debug_mode"}, kind: reflect.Bool},
+		{name: "list identity", segments: []string{"kafkaConsumers", "countries", "group_id"}, path: []interface{}{"kafkaConsumers", 1, "group_id"}, kind: reflect.String},
+		{name: "kafka setting of a consumer", segments: []string{"kafkaConsumers", "cities", "security", "tls", "enabled"}, path: []interface{}{"kafkaConsumers", 0, "security", "tls", "enabled"}, kind: reflect.Bool},
+		{name: "environment section", segments: []string{"redis", "production", "host"}, path: []interface{}{"redis", "production", "host"}, kind: reflect.String},
+		{name: "free-form setting", segments: []string{"kafkaConsumers", "0", "settings", "batch_size"}, path: []interface{}{"kafkaConsumers", 0, "settings", "batch_size"}, kind: reflect.Interface},
+		{name: "env index", segments: []string{"KAFKACONSUMERS", "0", "DEBUG", "MODE"}, greedy: true, path: []interface{}{"kafkaConsumers", 0, "debug_mode"}, kind: reflect.Bool},
+		{name: "env identity", segments: []string{"KAFKACONSUMERS", "CITIES", "GROUP", "ID"}, greedy: true, path: []interface{}{"kafkaConsumers", 0, "group_id"}, kind: reflect.String},
+		{name: "env environment section", segments: []string{"REDIS", "PRODUCTION", "HOST"}, greedy: true, path: []interface{}{"redis", "production", "host"}, kind: reflect.String},
+		{name: "env new free-form key", segments: []string{"KAFKACONSUMERS", "0", "SETTINGS", "MAX", "ROWS"}, greedy: true, path: []interface{}{"kafkaConsumers", 0, "settings", "max_rows"}, kind: reflect.Interface},
+		{name: "unknown field", segments: []string{"kafkaConsumers", "0", "debug"}, err: `unknown config field "debug"`},
+		{name: "index out of range", segments: []string{"kafkaConsumers", "2", "debug_mode"}, err: "index 2 out of range"},
+		{name: "unknown entry", segments: []string{"kafkaConsumers", "towns", "debug_mode"}, err: `no list entry matches "towns"`},
+		{name: "env unknown field", segments: []string{"KAFKACONSUMERS", "0", "VERBOSE"}, greedy: true, err: `unknown config field "VERBOSE"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, target, err := matchOverridePath(reflect.TypeOf(FullConfig{}), tree, tt.segments, tt.greedy)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(path, tt.path) {
+				t.Errorf("path = %v, want %v", path, tt.path)
+			}
+			if target == nil || target.Kind() != tt.kind {
+				t.Errorf("target = %v, want a %s", target, tt.kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Actions of the on_panic policy
+const (
+	panicStop = "stop"
+	panicExit = "exit"
+)
+
+const defaultPanicWindow = 10 * time.Minute
+
+var handlerPanicsTotal = metrics.counter("multiconsumer_handler_panics_total", "Handler calls that panicked.", "consumer")
+
+// ErrHandlerPanic is returned for a handler call that panicked. It counts as a
+// failure like any handler error.
+var ErrHandlerPanic = errors.New("handler panicked")
+
+// recoverHandlerPanic turns a panic of the handler call for message into an
+// ErrHandlerPanic in *err and logs it with the stack. It must be deferred
+// directly in the goroutine that calls the handler.
+func recoverHandlerPanic(err *error, message kafka.Message, logFunc func(level string, msg string, args ...interface{})) {
+	if r := recover(); r != nil {
+		logFunc("ERROR", "Handler panicked on message %s: %v\n%s", describeMessage(message), r, debug.Stack())
+		*err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+	}
+}
+
+// exitRequests receives the reason when a consumer's on_panic policy asks the
+// process to exit. main then stops every consumer as on a termination signal,
+// so that offsets, the producer and traces are flushed, and exits with status 1.
+var exitRequests = make(chan string, 1)
+
+// requestExit asks main to shut down and exit with an error; only the first
+// request is kept
+func requestExit(reason string) {
+	select {
+	case exitRequests <- reason:
+	default:
+	}
+}
+
+// recordPanic counts a handler panic against the consumer's on_panic policy.
+// Once the policy trips, the "stop" action stops the consumer, leaving the
+// others running, and "exit" also asks the process to shut down and exit;
+// both report true.
+func (kc *KafkaConsumer) recordPanic() bool {
+	handlerPanicsTotal.Inc(kc.consumerConfig.Name)
+	policy := kc.consumerConfig.OnPanic
+	if policy == nil || policy.MaxPanics <= 0 {
+		return false
+	}
+	window := time.Duration(policy.Window)
+	if window <= 0 {
+		window = defaultPanicWindow
+	}
+
+	kc.panicMu.Lock()
+	now := time.Now()
+	recent := kc.panics[:0]
+	for _, t := range kc.panics {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	kc.panics = append(recent, now)
+	count := len(kc.panics)
+	kc.panicMu.Unlock()
+	if count < policy.MaxPanics {
+		return false
+	}
+	if kc.ctx.Err() != nil {
+		return true // Already stopping
+	}
+
+	if policy.Action == panicExit {
+		kc.logger("ERROR", "Handler panicked %d times within %s; exiting", count, window)
+		requestExit(fmt.Sprintf("consumer %s: handler panicked %d times within %s", kc.consumerConfig.Name, count, window))
+		kc.cancel()
+		return true
+	}
+	kc.logger("ERROR", "Handler panicked %d times within %s; stopping the consumer", count, window)
+	reason := fmt.Sprintf("stopped after %d handler panics within %s", count, window)
+	health.register("consumers", kc.consumerConfig.Name, func() healthStatus {
+		return healthStatus{Status: healthDegraded, Details: map[string]interface{}{"reason": reason}}
+	})
+	// Stop waits for the handler loops, so only cancel from inside one
+	kc.cancel()
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newPanicTestConsumer returns a consumer with just what recordPanic uses
+func newPanicTestConsumer(name string, policy *PanicPolicyConfig) *KafkaConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaConsumer{
+		consumerConfig: ConsumerConfig{Name: name, OnPanic: policy},
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         discardLog,
+	}
+}
+
+func TestRecordPanicCounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *PanicPolicyConfig
+		earlier []time.Duration // ages of the panics recorded before
+		want    bool
+	}{
+		{name: "no policy", policy: nil, earlier: []time.Duration{time.Second, time.Second}, want: false},
+		{name: "below max_panics", policy: &PanicPolicyConfig{MaxPanics: 3, Window: Duration(time.Minute)}, earlier: []time.Duration{time.Second}, want: false},
+		{name: "at max_panics", policy: &PanicPolicyConfig{MaxPanics: 3, Window: Duration(time.Minute)}, earlier: []time.Duration{time.Second, 30 * time.Second}, want: true},
+		{name: "older panics expire", policy: &PanicPolicyConfig{MaxPanics: 3, Window: Duration(time.Minute)}, earlier: []time.Duration{2 * time.Minute, time.Second}, want: false},
+		{name: "default window", policy: &PanicPolicyConfig{MaxPanics: 2}, earlier: []time.Duration{9 * time.Minute}, want: true},
+		{name: "outside the default window", policy: &PanicPolicyConfig{MaxPanics: 2}, earlier: []time.Duration{11 * time.Minute}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc := newPanicTestConsumer("test-panic-counting", tt.policy)
+			defer kc.cancel()
+			for _, age := range tt.earlier {
+				kc.panics = append(kc.panics, time.Now().Add(-age))
+			}
+			if got := kc.recordPanic(); got != tt.want {
+				t.Errorf("recordPanic() = %v, want %v", got, tt.want)
+			}
+			if tt.policy != nil && tt.policy.MaxPanics > 0 && len(kc.panics) > tt.policy.MaxPanics {
+				t.Errorf("%d panics kept, want expired ones dropped", len(kc.panics))
+			}
+		})
+	}
+}
+
+func TestRecordPanicStop(t *testing.T) {
+	kc := newPanicTestConsumer("test-panic-stop", &PanicPolicyConfig{MaxPanics: 2, Action: panicStop})
+	defer health.register("consumers", "test-panic-stop", func() healthStatus { return healthStatus{Status: healthOK} })
+
+	if kc.recordPanic() {
+		t.Fatal("recordPanic() = true after the first panic")
+	}
+	if kc.ctx.Err() != nil {
+		t.Fatal("consumer stopped below max_panics")
+	}
+	if !kc.recordPanic() {
+		t.Fatal("recordPanic() = false at max_panics")
+	}
+	if kc.ctx.Err() == nil {
+		t.Error("consumer was not stopped")
+	}
+	_, body := health.report()
+	if status := body["consumers"].(map[string]healthStatus)["test-panic-stop"]; status.Status != healthDegraded {
+		t.Errorf("health = %s, want %s", status.Status, healthDegraded)
+	}
+	select {
+	case reason := <-exitRequests:
+		t.Errorf("stop requested an exit: %s", reason)
+	default:
+	}
+
+	// Panics of calls still running while the consumer stops are not reported again
+	if !kc.recordPanic() {
+		t.Error("recordPanic() = false for a stopping consumer")
+	}
+}
+
+func TestRecordPanicExit(t *testing.T) {
+	kc := newPanicTestConsumer("test-panic-exit", &PanicPolicyConfig{MaxPanics: 1, Action: panicExit})
+	if !kc.recordPanic() {
+		t.Fatal("recordPanic() = false at max_panics")
+	}
+	if kc.ctx.Err() == nil {
+		t.Error("consumer was not stopped")
+	}
+	select {
+	case reason := <-exitRequests:
+		if reason != "consumer test-panic-exit: handler panicked 1 times within 10m0s" {
+			t.Errorf("exit reason = %q", reason)
+		}
+	default:
+		t.Error("no exit was requested")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// defaultProducerBatchTimeout keeps synchronous writes from waiting for a full
+// batch; kafka-go waits up to a second by default
+const defaultProducerBatchTimeout = 10 * time.Millisecond
+
+// Producer publishes messages for handlers. It keeps one kafka.Writer per
+// topic, created on first use with the topic's settings, and all writers share
+// one transport and its connections.
+type Producer struct {
+	config    ProducerConfig
+	brokers   []string
+	transport *kafka.Transport
+	mu        sync.Mutex
+	writers   map[string]*kafka.Writer
+	closed    bool
+}
+
+// NewProducer creates the shared producer for the environment's brokers
+func NewProducer(config ProducerConfig, kafkaConfig KafkaConfig) (*Producer, error) {
+	transport, err := newTransport(kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{
+		config:    config,
+		brokers:   kafkaConfig.Brokers,
+		transport: transport,
+		writers:   make(map[string]*kafka.Writer),
+	}, nil
+}
+
+// Produce writes messages to the topics set on them and returns once they were
+// acknowledged as configured for each topic. The trace context of ctx is added
+// to their headers.
+func (p *Producer) Produce(ctx context.Context, messages ...kafka.Message) error {
+	var topics []string
+	byTopic := make(map[string][]kafka.Message)
+	for _, message := range messages {
+		if message.Topic == "" {
+			return errors.New("message has no topic")
+		}
+		if _, ok := byTopic[message.Topic]; !ok {
+			topics = append(topics, message.Topic)
+		}
+		topic := message.Topic
+		message.Topic = ""
+		propagator.Inject(ctx, headerCarrier{&message.Headers})
+		byTopic[topic] = append(byTopic[topic], message)
+	}
+
+	for _, topic := range topics {
+		writer, err := p.writer(topic)
+		if err != nil {
+			return err
+		}
+		if err := writer.WriteMessages(ctx, byTopic[topic]...); err != nil {
+			return fmt.Errorf("failed to produce to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// writer returns the writer for topic, creating it on first use
+func (p *Producer) writer(topic string) (*kafka.Writer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errors.New("producer is closed")
+	}
+	if writer, ok := p.writers[topic]; ok {
+		return writer, nil
+	}
+
+	writer, err := newTopicWriter(p.config.topic(topic))
+	if err != nil {
+		return nil, fmt.Errorf("producer settings for %s: %w", topic, err)
+	}
+	writer.Addr = kafka.TCP(p.brokers...)
+	writer.Topic = topic
+	writer.Transport = p.transport
+	p.writers[topic] = writer
+	return writer, nil
+}
+
+// Close flushes and closes every writer. It is called once the consumers have
+// stopped, so that messages produced by their last handlers are delivered.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var errs []error
+	for topic, writer := range p.writers {
+		if err := writer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", topic, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// topic returns the settings for topic: its own settings over the defaults
+func (c ProducerConfig) topic(topic string) TopicProducerConfig {
+	return overlay(c.Defaults, c.Topics[topic])
+}
+
+// newTopicWriter builds a writer, without address or topic, from topic settings
+func newTopicWriter(config TopicProducerConfig) (*kafka.Writer, error) {
+	writer := &kafka.Writer{
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchSize:    config.BatchSize,
+		BatchBytes:   config.BatchBytes,
+		BatchTimeout: defaultProducerBatchTimeout,
+	}
+	if config.BatchTimeout > 0 {
+		writer.BatchTimeout = time.Duration(config.BatchTimeout)
+	}
+
+	switch strings.ToLower(config.Balancer) {
+	case "", "hash":
+	case "round_robin":
+		writer.Balancer = &kafka.RoundRobin{}
+	case "least_bytes":
+		writer.Balancer = &kafka.LeastBytes{}
+	case "crc32":
+		writer.Balancer = kafka.CRC32Balancer{}
+	case "murmur2":
+		writer.Balancer = kafka.Murmur2Balancer{}
+	default:
+		return nil, fmt.Errorf("unknown balancer %q (available: hash, round_robin, least_bytes, crc32, murmur2)", config.Balancer)
+	}
+
+	if config.Acks != "" {
+		if err := writer.RequiredAcks.UnmarshalText([]byte(strings.ToLower(config.Acks))); err != nil {
+			return nil, err
+		}
+	}
+
+	switch strings.ToLower(config.Compression) {
+	case "", "none":
+	case "gzip":
+		writer.Compression = kafka.Gzip
+	case "snappy":
+		writer.Compression = kafka.Snappy
+	case "lz4":
+		writer.Compression = kafka.Lz4
+	case "zstd":
+		writer.Compression = kafka.Zstd
+	default:
+		return nil, fmt.Errorf("unknown compression %q (available: none, gzip, snappy, lz4, zstd)", config.Compression)
+	}
+	return writer, nil
+}
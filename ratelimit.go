@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// adaptiveWindow is how often the adaptive rate is adjusted
+	adaptiveWindow = time.Second
+
+	defaultMinMessagesPerSecond = 1
+)
+
+var (
+	rateLimitWaitSeconds = metrics.counter("multiconsumer_rate_limit_wait_seconds_total", "Time spent waiting for the rate limits.", "consumer")
+	rateLimitMessages    = metrics.gauge("multiconsumer_rate_limit_messages_per_second", "Current message rate limit; lowered by the adaptive mode.", "consumer")
+	inFlightMessages     = metrics.gauge("multiconsumer_in_flight_messages", "Messages being handled.", "consumer")
+)
+
+// tokenBucket refills rate tokens per second up to one second's worth. It may
+// go into debt, so that a message larger than the bucket still passes and
+// delays the ones after it instead.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take removes n tokens and returns how long to wait until the bucket is out of debt
+func (b *tokenBucket) take(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate > 0 {
+		b.refill(time.Now())
+	}
+	b.rate = rate
+	b.burst = max(rate, 1)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// sink holds the budget and circuit breaker of a sink, shared by every
+// consumer writing to it
+type sink struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+	breaker  *circuitBreaker
+}
+
+// newSinks creates the shared limiters and breakers of the configured sinks
+func newSinks(configs map[string]SinkConfig) map[string]*sink {
+	sinks := make(map[string]*sink)
+	for name, config := range configs {
+		s := &sink{}
+		if config.MessagesPerSecond > 0 {
+			s.messages = newTokenBucket(config.MessagesPerSecond)
+		}
+		if config.BytesPerSecond > 0 {
+			s.bytes = newTokenBucket(config.BytesPerSecond)
+		}
+		if config.CircuitBreaker != nil {
+			s.breaker = newCircuitBreaker("sink/"+name, *config.CircuitBreaker)
+		}
+		sinks[name] = s
+	}
+	return sinks
+}
+
+// consumerLimiter applies a consumer's rate_limit and the limits of its sinks.
+// Waiting for it holds the message in the handler loop, which stops the
+// partition readers once their queues are full, so fetching slows down with
+// it. A nil limiter does nothing.
+type consumerLimiter struct {
+	consumer string
+	buckets  []*tokenBucket // message buckets
+	bytes    []*tokenBucket
+	inFlight chan struct{}
+	adaptive *adaptiveRate
+}
+
+func newConsumerLimiter(config ConsumerConfig, sinks map[string]*sink, logger func(level string, msg string, args ...interface{})) *consumerLimiter {
+	l := &consumerLimiter{consumer: config.Name}
+	if limit := config.RateLimit; limit != nil {
+		if limit.MessagesPerSecond > 0 {
+			bucket := newTokenBucket(limit.MessagesPerSecond)
+			l.buckets = append(l.buckets, bucket)
+			rateLimitMessages.Set(limit.MessagesPerSecond, config.Name)
+			if limit.Adaptive != nil {
+				l.adaptive = newAdaptiveRate(config.Name, limit, bucket, logger)
+			}
+		}
+		if limit.BytesPerSecond > 0 {
+			l.bytes = append(l.bytes, newTokenBucket(limit.BytesPerSecond))
+		}
+		if limit.MaxInFlight > 0 {
+			l.inFlight = make(chan struct{}, limit.MaxInFlight)
+		}
+	}
+	for _, name := range config.Sinks {
+		if s := sinks[name]; s != nil {
+			if s.messages != nil {
+				l.buckets = append(l.buckets, s.messages)
+			}
+			if s.bytes != nil {
+				l.bytes = append(l.bytes, s.bytes)
+			}
+		}
+	}
+	if len(l.buckets) == 0 && len(l.bytes) == 0 && l.inFlight == nil {
+		return nil
+	}
+	return l
+}
+
+// acquire waits until message may be handled. It returns false if ctx ends first.
+func (l *consumerLimiter) acquire(ctx context.Context, message kafka.Message) bool {
+	if l == nil {
+		return true
+	}
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	inFlightMessages.Add(1, l.consumer)
+
+	var wait time.Duration
+	for _, bucket := range l.buckets {
+		wait = max(wait, bucket.take(1))
+	}
+	size := float64(len(message.Key) + len(message.Value))
+	for _, bucket := range l.bytes {
+		wait = max(wait, bucket.take(size))
+	}
+	if wait <= 0 {
+		return true
+	}
+	start := time.Now()
+	defer func() { rateLimitWaitSeconds.Add(time.Since(start).Seconds(), l.consumer) }()
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		l.release()
+		return false
+	}
+}
+
+// release frees the in-flight slot taken by acquire
+func (l *consumerLimiter) release() {
+	if l == nil {
+		return
+	}
+	inFlightMessages.Add(-1, l.consumer)
+	if l.inFlight != nil {
+		<-l.inFlight
+	}
+}
+
+// observe records the latency and outcome of one handler call for the adaptive mode
+func (l *consumerLimiter) observe(latency time.Duration, failed bool) {
+	if l != nil && l.adaptive != nil {
+		l.adaptive.observe(latency, failed)
+	}
+}
+
+// adaptiveRate lowers a consumer's message rate while the handler is slow or
+// failing and raises it back once it recovers: it halves the rate after a
+// window that missed the target, and adds a tenth of the configured rate after
+// one that met it
+type adaptiveRate struct {
+	consumer string
+	bucket   *tokenBucket
+	logger   func(level string, msg string, args ...interface{})
+
+	targetLatency time.Duration
+	maxErrorRate  float64
+	minRate       float64
+	maxRate       float64
+
+	mu       sync.Mutex
+	rate     float64
+	start    time.Time
+	calls    int
+	failures int
+	latency  time.Duration
+}
+
+func newAdaptiveRate(consumer string, limit *RateLimitConfig, bucket *tokenBucket, logger func(level string, msg string, args ...interface{})) *adaptiveRate {
+	a := &adaptiveRate{
+		consumer:      consumer,
+		bucket:        bucket,
+		logger:        logger,
+		targetLatency: time.Duration(limit.Adaptive.TargetLatency),
+		maxErrorRate:  limit.Adaptive.MaxErrorRate,
+		minRate:       limit.Adaptive.MinMessagesPerSecond,
+		maxRate:       limit.MessagesPerSecond,
+		rate:          limit.MessagesPerSecond,
+		start:         time.Now(),
+	}
+	if a.minRate <= 0 {
+		a.minRate = min(defaultMinMessagesPerSecond, a.maxRate)
+	}
+	return a
+}
+
+func (a *adaptiveRate) observe(latency time.Duration, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	a.latency += latency
+	if failed {
+		a.failures++
+	}
+	if time.Since(a.start) < adaptiveWindow {
+		return
+	}
+
+	average := a.latency / time.Duration(a.calls)
+	errorRate := float64(a.failures) / float64(a.calls)
+	rate, level, reason := a.rate, "", ""
+	switch {
+	case a.targetLatency > 0 && average > a.targetLatency:
+		rate = max(a.minRate, a.rate/2)
+		level, reason = "WARNING", fmt.Sprintf("handler latency %s is above %s", average, a.targetLatency)
+	case a.maxErrorRate > 0 && errorRate > a.maxErrorRate:
+		rate = max(a.minRate, a.rate/2)
+		level, reason = "WARNING", fmt.Sprintf("handler error rate %.2f is above %.2f", errorRate, a.maxErrorRate)
+	case a.rate < a.maxRate:
+		rate = min(a.maxRate, a.rate+a.maxRate/10)
+		level, reason = "INFO", "handler recovered"
+	}
+	if rate != a.rate {
+		a.logger(level, "Rate limit changed from %.1f to %.1f messages/s: %s", a.rate, rate, reason)
+		a.rate = rate
+		a.bucket.setRate(rate)
+		rateLimitMessages.Set(rate, a.consumer)
+	}
+	a.start = time.Now()
+	a.calls, a.failures, a.latency = 0, 0, 0
+}
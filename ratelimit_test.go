@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		takes   []float64
+		elapsed time.Duration // before the last take
+		want    time.Duration // wait returned by the last take
+	}{
+		{name: "within the burst", rate: 10, takes: []float64{5, 5}, want: 0},
+		{name: "past the burst", rate: 10, takes: []float64{10, 5}, want: 500 * time.Millisecond},
+		{name: "larger than the bucket", rate: 10, takes: []float64{30}, want: 2 * time.Second},
+		{name: "debt delays the next take", rate: 10, takes: []float64{30, 1}, want: 2100 * time.Millisecond},
+		{name: "refills over time", rate: 10, takes: []float64{10, 5}, elapsed: 500 * time.Millisecond, want: 0},
+		{name: "refills up to the burst only", rate: 10, takes: []float64{1, 15}, elapsed: time.Hour, want: 500 * time.Millisecond},
+		{name: "burst of at least one token", rate: 0.5, takes: []float64{1, 1}, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newTokenBucket(tt.rate)
+			var wait time.Duration
+			for i, n := range tt.takes {
+				if i == len(tt.takes)-1 {
+					// Backdate the bucket instead of sleeping
+					bucket.last = bucket.last.Add(-tt.elapsed)
+				}
+				wait = bucket.take(n)
+			}
+			if diff := wait - tt.want; diff < -10*time.Millisecond || diff > 10*time.Millisecond {
+				t.Errorf("wait = %s, want %s", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	bucket := newTokenBucket(100)
+	bucket.setRate(10)
+	if bucket.tokens != 10 || bucket.burst != 10 {
+		t.Errorf("after lowering the rate: tokens = %v, burst = %v, want 10 and 10", bucket.tokens, bucket.burst)
+	}
+
+	bucket.setRate(50)
+	if bucket.burst != 50 || bucket.tokens > 11 {
+		t.Errorf("after raising the rate: tokens = %v, burst = %v, want at most 11 and 50", bucket.tokens, bucket.burst)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// replayRange is the offset range [Start, End) replayed from one partition
+type replayRange struct {
+	Topic     string
+	Partition int
+	Start     int64
+	End       int64
+}
+
+// replayCounts tallies the outcome of replayed messages, with the offsets of
+// the failed ones per partition
+type replayCounts struct {
+	Processed     int
+	Failed        int
+	Skipped       int
+	FailedOffsets []failedOffsets
+}
+
+// failedOffsets lists the offsets of one partition whose handler call failed
+type failedOffsets struct {
+	Topic     string
+	Partition int
+	Offsets   []int64
+}
+
+func (c *replayCounts) add(other replayCounts) {
+	c.Processed += other.Processed
+	c.Failed += other.Failed
+	c.Skipped += other.Skipped
+	c.FailedOffsets = append(c.FailedOffsets, other.FailedOffsets...)
+}
+
+// formatOffsets lists ascending offsets, joining consecutive ones into ranges
+// such as "12-15"
+func formatOffsets(offsets []int64) string {
+	var parts []string
+	for i := 0; i < len(offsets); {
+		j := i
+		for j+1 < len(offsets) && offsets[j+1] == offsets[j]+1 {
+			j++
+		}
+		if j == i {
+			parts = append(parts, strconv.FormatInt(offsets[i], 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", offsets[i], offsets[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// replayCommand implements "replay": it runs a consumer's handler over a
+// bounded offset or time range without a consumer group, so no offsets are
+// committed, and exits with a summary when the range is done
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags := addConfigFlags(fs)
+	consumerName := fs.String("consumer", "", "Name of the consumer whose handler, settings and sinks are used")
+	var topics stringList
+	fs.Var(&topics, "topic", "Topic to replay, instead of the consumer's topics (comma-separated or repeated)")
+	partition := fs.Int("partition", -1, "Partition to replay (default all partitions)")
+	fromOffset := fs.Int64("from-offset", -1, "First offset to replay; requires -partition")
+	toOffset := fs.Int64("to-offset", -1, "Offset to stop before; requires -partition")
+	from := fs.String("from", "", "Replay messages from this RFC 3339 timestamp")
+	to := fs.String("to", "", "Replay messages before this RFC 3339 timestamp (default up to the current end of each partition)")
+	fs.Parse(args)
+
+	if *consumerName == "" {
+		fmt.Fprintln(os.Stderr, "-consumer is required")
+		return 2
+	}
+	if (*fromOffset >= 0) == (*from != "") {
+		fmt.Fprintln(os.Stderr, "Exactly one of -from-offset or -from is required")
+		return 2
+	}
+	if *toOffset >= 0 && *to != "" {
+		fmt.Fprintln(os.Stderr, "Use either -to-offset or -to, not both")
+		return 2
+	}
+	if (*fromOffset >= 0 || *toOffset >= 0) && *partition < 0 {
+		fmt.Fprintln(os.Stderr, "-from-offset and -to-offset require -partition")
+		return 2
+	}
+	var fromTime, toTime time.Time
+	for _, bound := range []struct {
+		name  string
+		value string
+		at    *time.Time
+	}{{"-from", *from, &fromTime}, {"-to", *to, &toTime}} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, bound.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s %q: expected an RFC 3339 timestamp\n", bound.name, bound.value)
+			return 2
+		}
+		*bound.at = parsed
+	}
+
+	config, err := loadConfig(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if errs := ValidateConfig(config, *flags.env); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Configuration has %d problem(s) for environment %s:\n%v\n", len(errs), *flags.env, errs)
+		return 1
+	}
+	environment, err := GetEnvConfig(*flags.env, *config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to resolve environment: %v\n", err)
+		return 1
+	}
+	consumer, err := findConsumer(config, environment, *consumerName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(topics) == 0 {
+		if topics, err = consumerTopics(consumer); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+	if len(topics) == 0 {
+		fmt.Fprintln(os.Stderr, "No topics to replay")
+		return 1
+	}
+	if *fromOffset >= 0 && len(topics) > 1 {
+		fmt.Fprintln(os.Stderr, "-from-offset requires a single topic; select one with -topic")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	client, err := newClient(consumer.KafkaConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure Kafka connection: %v\n", err)
+		return 1
+	}
+	defer closeClient(client)
+	partitions, err := topicPartitions(ctx, client, topics)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read topic metadata: %v\n", err)
+		return 1
+	}
+	if *partition >= 0 {
+		for topic, ids := range partitions {
+			partitions[topic] = nil
+			for _, id := range ids {
+				if id == *partition {
+					partitions[topic] = []int{id}
+				}
+			}
+			if partitions[topic] == nil {
+				fmt.Fprintf(os.Stderr, "Topic %s has no partition %d\n", topic, *partition)
+				return 1
+			}
+		}
+	}
+
+	ranges, err := planReplay(ctx, client, partitions, *fromOffset, *toOffset, fromTime, toTime)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to plan the replay: %v\n", err)
+		return 1
+	}
+
+	dialer, err := newDialer(consumer.KafkaConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure Kafka connection: %v\n", err)
+		return 1
+	}
+	logger := customLogger(consumer.LogPrefix+"/replay", os.Stderr, consumer.DebugMode)
+	// Forwarding handlers forward every replayed message again, even if it was forwarded before
+	producer, err := NewProducer(config.Producer, environment.Kafka)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure producer: %v\n", err)
+		return 1
+	}
+	defer producer.Close()
+	deps := HandlerDeps{Redis: environment.Redis, Mongo: environment.Mongo, MySQL: environment.MySQL, Producer: producer}
+	handlerFunc, closeHandler, err := newMessageHandler(consumer, deps, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up handler: %v\n", err)
+		return 1
+	}
+	defer closeHandler()
+	// Replayed messages get the same timeout, watchdog and panic recovery as consumed ones
+	abandoned := newAbandonedCalls(consumer)
+	handle := func(message kafka.Message) error {
+		if !abandoned.wait(ctx, logger) {
+			return ctx.Err()
+		}
+		return runHandler(ctx, consumer, handlerFunc, message, logger, abandoned)
+	}
+
+	var total replayCounts
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "TOPIC\tPARTITION\tSTART-OFFSET\tEND-OFFSET\tPROCESSED\tFAILED\tSKIPPED\n")
+	for _, r := range ranges {
+		counts, err := replayPartition(ctx, consumer, dialer, r, fromTime, toTime, handle, logger)
+		total.add(counts)
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", r.Topic, r.Partition, r.Start, r.End, counts.Processed, counts.Failed, counts.Skipped)
+		if err != nil {
+			table.Flush()
+			fmt.Fprintf(os.Stderr, "Replay of %s/%d stopped: %v\n", r.Topic, r.Partition, err)
+			break
+		}
+	}
+	table.Flush()
+	fmt.Printf("Replayed %d message(s): %d processed, %d failed, %d skipped\n",
+		total.Processed+total.Failed+total.Skipped, total.Processed, total.Failed, total.Skipped)
+	for _, failed := range total.FailedOffsets {
+		fmt.Printf("Failed offsets of %s/%d: %s\n", failed.Topic, failed.Partition, formatOffsets(failed.Offsets))
+	}
+
+	if total.Failed > 0 || ctx.Err() != nil {
+		return 1
+	}
+	return 0
+}
+
+// planReplay computes the offset range of every partition. A start or end
+// given as a time is the first offset at or after that time; without an end
+// the range stops at the partition's current end.
+func planReplay(ctx context.Context, client *kafka.Client, partitions map[string][]int, fromOffset, toOffset int64, fromTime, toTime time.Time) ([]replayRange, error) {
+	marks, err := fetchWatermarks(ctx, client, partitions)
+	if err != nil {
+		return nil, err
+	}
+	var startsByTime, endsByTime partitionOffsets
+	if !fromTime.IsZero() {
+		if startsByTime, err = fetchOffsetsForTime(ctx, client, partitions, fromTime); err != nil {
+			return nil, err
+		}
+	}
+	if !toTime.IsZero() {
+		if endsByTime, err = fetchOffsetsForTime(ctx, client, partitions, toTime); err != nil {
+			return nil, err
+		}
+	}
+
+	var ranges []replayRange
+	for _, topic := range sortedKeys(partitions) {
+		for _, partition := range partitions[topic] {
+			mark := marks[topic][partition]
+			start, end := fromOffset, toOffset
+			if startsByTime != nil {
+				if start, _ = startsByTime.get(topic, partition); start < 0 {
+					start = mark.Last
+				}
+			}
+			if endsByTime != nil {
+				if end, _ = endsByTime.get(topic, partition); end < 0 {
+					end = mark.Last
+				}
+			}
+			if end < 0 || end > mark.Last {
+				end = mark.Last
+			}
+			if start < mark.First {
+				start = mark.First
+			}
+			if start > end {
+				start = end
+			}
+			ranges = append(ranges, replayRange{Topic: topic, Partition: partition, Start: start, End: end})
+		}
+	}
+	return ranges, nil
+}
+
+// replayPartition reads one partition range without a consumer group and passes
+// each message to handle. Messages whose timestamp falls outside the time range
+// are skipped, as are messages the handler skips with ErrSkipMessage.
+func replayPartition(ctx context.Context, consumer ConsumerConfig, dialer *kafka.Dialer, r replayRange, fromTime, toTime time.Time, handle func(kafka.Message) error, logger func(level string, msg string, args ...interface{})) (replayCounts, error) {
+	var counts replayCounts
+	err := readRange(ctx, consumer.KafkaConfig, dialer, r.Topic, r.Partition, r.Start, r.End, func(message kafka.Message) error {
+		if (!fromTime.IsZero() && message.Time.Before(fromTime)) || (!toTime.IsZero() && !message.Time.Before(toTime)) {
+			counts.Skipped++
+			return nil
+		}
+		err := handle(message)
+		switch {
+		case errors.Is(err, ErrSkipMessage):
+			counts.Skipped++
+		case err != nil:
+			counts.Failed++
+			if len(counts.FailedOffsets) == 0 {
+				counts.FailedOffsets = []failedOffsets{{Topic: r.Topic, Partition: r.Partition}}
+			}
+			counts.FailedOffsets[0].Offsets = append(counts.FailedOffsets[0].Offsets, message.Offset)
+			logger("ERROR", "Handler failed for message %s: %v", describeMessage(message), err)
+		default:
+			counts.Processed++
+		}
+		return nil
+	})
+	if errors.Is(err, errRangeIdle) {
+		logger("WARNING", "No more messages in %s/%d before offset %d; ending its replay", r.Topic, r.Partition, r.End)
+		return counts, nil
+	}
+	return counts, err
+}
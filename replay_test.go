@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+)
+
+// fakeOffsets is a kafka.RoundTripper that answers ListOffsets requests from
+// the message timestamps of each partition
+type fakeOffsets struct {
+	first map[int]int64       // first offset per partition
+	times map[int][]time.Time // timestamps of the messages from the first offset on
+}
+
+func (f *fakeOffsets) RoundTrip(ctx context.Context, addr net.Addr, request kafka.Request) (kafka.Response, error) {
+	list, ok := request.(*listoffsets.Request)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request %T", request)
+	}
+	response := &listoffsets.Response{}
+	for _, topic := range list.Topics {
+		responseTopic := listoffsets.ResponseTopic{Topic: topic.Topic}
+		for _, requested := range topic.Partitions {
+			partition := int(requested.Partition)
+			first := f.first[partition]
+			found := listoffsets.ResponsePartition{Partition: requested.Partition, Timestamp: requested.Timestamp, Offset: -1}
+			switch requested.Timestamp {
+			case kafka.FirstOffset:
+				found.Offset = first
+			case kafka.LastOffset:
+				found.Offset = first + int64(len(f.times[partition]))
+			default:
+				found.Timestamp = -1
+				for i, at := range f.times[partition] {
+					if !at.Before(time.UnixMilli(requested.Timestamp)) {
+						found.Offset, found.Timestamp = first+int64(i), requested.Timestamp
+						break
+					}
+				}
+			}
+			responseTopic.Partitions = append(responseTopic.Partitions, found)
+		}
+		response.Topics = append(response.Topics, responseTopic)
+	}
+	return response, nil
+}
+
+func TestPlanReplay(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	minutes := func(from, count int) []time.Time {
+		var times []time.Time
+		for i := 0; i < count; i++ {
+			times = append(times, base.Add(time.Duration(from+i)*time.Minute))
+		}
+		return times
+	}
+	// Partition 0 holds offsets 100-109 written at minutes 0-9, partition 1
+	// offsets 0-4 at minutes 0-4 and partition 2 is empty
+	client := &kafka.Client{Addr: kafka.TCP("localhost:9092"), Transport: &fakeOffsets{
+		first: map[int]int64{0: 100, 1: 0, 2: 7},
+		times: map[int][]time.Time{0: minutes(0, 10), 1: minutes(0, 5)},
+	}}
+	partitions := map[string][]int{"orders": {0, 1, 2}}
+
+	tests := []struct {
+		name       string
+		fromOffset int64
+		toOffset   int64
+		fromTime   time.Time
+		toTime     time.Time
+		want       []replayRange
+	}{
+		{
+			name:     "whole partitions",
+			toOffset: -1,
+			want:     []replayRange{{"orders", 0, 100, 110}, {"orders", 1, 0, 5}, {"orders", 2, 7, 7}},
+		},
+		{
+			name:       "offsets clamped to the partitions",
+			fromOffset: 103,
+			toOffset:   108,
+			want:       []replayRange{{"orders", 0, 103, 108}, {"orders", 1, 5, 5}, {"orders", 2, 7, 7}},
+		},
+		{
+			name:     "from a time",
+			toOffset: -1,
+			fromTime: base.Add(3 * time.Minute),
+			want:     []replayRange{{"orders", 0, 103, 110}, {"orders", 1, 3, 5}, {"orders", 2, 7, 7}},
+		},
+		{
+			name:     "time range",
+			fromTime: base.Add(2 * time.Minute),
+			toTime:   base.Add(4*time.Minute + time.Second),
+			want:     []replayRange{{"orders", 0, 102, 105}, {"orders", 1, 2, 5}, {"orders", 2, 7, 7}},
+		},
+		{
+			name:     "start after the last message",
+			toOffset: -1,
+			fromTime: base.Add(time.Hour),
+			want:     []replayRange{{"orders", 0, 110, 110}, {"orders", 1, 5, 5}, {"orders", 2, 7, 7}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planReplay(context.Background(), client, partitions, tt.fromOffset, tt.toOffset, tt.fromTime, tt.toTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranges:\n%+v\nwant:\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatOffsets(t *testing.T) {
+	tests := []struct {
+		offsets []int64
+		want    string
+	}{
+		{offsets: nil, want: ""},
+		{offsets: []int64{7}, want: "7"},
+		{offsets: []int64{3, 5, 9}, want: "3, 5, 9"},
+		{offsets: []int64{12, 13, 14, 15}, want: "12-15"},
+		{offsets: []int64{1, 2, 4, 6, 7, 8, 10}, want: "1-2, 4, 6-8, 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatOffsets(tt.offsets); got != tt.want {
+				t.Errorf("formatOffsets(%v) = %q, want %q", tt.offsets, got, tt.want)
+			}
+		})
+	}
+}
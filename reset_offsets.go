@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// resetOffsetsCommand implements "reset-offsets": it moves the committed
+// offsets of a consumer group to earliest, latest, a point in time, or shifts
+// them by a number of messages
+func resetOffsetsCommand(args []string) int {
+	fs := flag.NewFlagSet("reset-offsets", flag.ExitOnError)
+	flags := addConfigFlags(fs)
+	consumerName := fs.String("consumer", "", "Name of the consumer whose group and topics are reset")
+	groupID := fs.String("group", "", "Consumer group to reset, instead of -consumer")
+	var topics stringList
+	fs.Var(&topics, "topic", "Topic to reset, instead of the consumer's topics (comma-separated or repeated)")
+	to := fs.String("to", "", "Target offset: earliest, latest or an RFC 3339 timestamp")
+	shiftBy := fs.Int64("shift-by", 0, "Move the committed offsets by N messages (negative to go back)")
+	dryRun := fs.Bool("dry-run", false, "Print the plan per partition without committing it")
+	fs.Parse(args)
+
+	shift := false
+	fs.Visit(func(f *flag.Flag) { shift = shift || f.Name == "shift-by" })
+	if (*to == "") == !shift {
+		fmt.Fprintln(os.Stderr, "Exactly one of -to or -shift-by is required")
+		return 2
+	}
+
+	var at time.Time
+	if *to != "" && *to != "earliest" && *to != "latest" {
+		parsed, err := time.Parse(time.RFC3339Nano, *to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -to %q: expected earliest, latest or an RFC 3339 timestamp\n", *to)
+			return 2
+		}
+		at = parsed
+	}
+
+	kafkaConfig, group, topicList, err := resetTarget(flags, *consumerName, *groupID, topics)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := newClient(kafkaConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure Kafka connection: %v\n", err)
+		return 1
+	}
+	defer closeClient(client)
+	if len(topicList) == 0 {
+		fmt.Fprintln(os.Stderr, "No topics to reset")
+		return 1
+	}
+
+	partitions, err := topicPartitions(ctx, client, topicList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read topic metadata: %v\n", err)
+		return 1
+	}
+	current, err := fetchCommittedOffsets(ctx, client, group, partitions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read committed offsets: %v\n", err)
+		return 1
+	}
+	marks, err := fetchWatermarks(ctx, client, partitions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read partition offsets: %v\n", err)
+		return 1
+	}
+	var byTime partitionOffsets
+	if !at.IsZero() {
+		if byTime, err = fetchOffsetsForTime(ctx, client, partitions, at); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to look up offsets for %s: %v\n", *to, err)
+			return 1
+		}
+	}
+
+	plan := make(partitionOffsets)
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "GROUP\tTOPIC\tPARTITION\tCURRENT-OFFSET\tNEW-OFFSET\tLOG-START-OFFSET\tLOG-END-OFFSET\n")
+	for _, topic := range sortedKeys(partitions) {
+		for _, partition := range partitions[topic] {
+			mark := marks[topic][partition]
+			committed, ok := current.get(topic, partition)
+			if !ok {
+				committed = -1
+			}
+
+			target := int64(-1)
+			switch {
+			case shift && committed >= 0:
+				target = clampOffset(committed+*shiftBy, mark)
+			case *to == "earliest":
+				target = mark.First
+			case *to == "latest":
+				target = mark.Last
+			case !at.IsZero():
+				target, _ = byTime.get(topic, partition)
+				if target < 0 {
+					target = mark.Last
+				}
+			}
+
+			newOffset := "-"
+			if target >= 0 {
+				plan.set(topic, partition, target)
+				newOffset = strconv.FormatInt(target, 10)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%d\t%d\n", group, topic, partition, formatOffset(committed), newOffset, mark.First, mark.Last)
+		}
+	}
+	table.Flush()
+
+	if shift {
+		fmt.Println("Partitions without a committed offset are not shifted.")
+	}
+	if *dryRun {
+		fmt.Println("Dry run: no offsets were changed.")
+		return 0
+	}
+
+	state, members, err := groupState(ctx, client, group)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to describe group %s: %v\n", group, err)
+		return 1
+	}
+	if members > 0 {
+		fmt.Fprintf(os.Stderr, "Group %s is %s with %d active member(s); stop its consumers before resetting offsets\n", group, state, members)
+		return 1
+	}
+	if len(plan) == 0 {
+		fmt.Println("Nothing to reset.")
+		return 0
+	}
+	if err := commitGroupOffsets(ctx, client, group, plan); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to commit offsets: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Offsets of group %s were reset.\n", group)
+	return 0
+}
+
+// resetTarget resolves the Kafka settings, group and topics to reset from either
+// a configured consumer or explicit -group and -topic flags
+func resetTarget(flags *configFlags, consumerName, groupID string, topics []string) (KafkaConfig, string, []string, error) {
+	config, err := loadConfig(flags)
+	if err != nil {
+		return KafkaConfig{}, "", nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	environment, err := GetEnvConfig(*flags.env, *config)
+	if err != nil {
+		return KafkaConfig{}, "", nil, fmt.Errorf("failed to resolve environment: %w", err)
+	}
+
+	if consumerName == "" {
+		if groupID == "" || len(topics) == 0 {
+			return KafkaConfig{}, "", nil, fmt.Errorf("either -consumer or both -group and -topic are required")
+		}
+		return environment.Kafka, groupID, topics, nil
+	}
+
+	consumer, err := findConsumer(config, environment, consumerName)
+	if err != nil {
+		return KafkaConfig{}, "", nil, err
+	}
+	if groupID == "" {
+		groupID = consumer.GroupID
+	}
+	if len(topics) > 0 {
+		return consumer.KafkaConfig, groupID, topics, nil
+	}
+	topicList, err := consumerTopics(consumer)
+	return consumer.KafkaConfig, groupID, topicList, err
+}
+
+// findConsumer returns the named consumer with the environment's Kafka
+// settings layered under its own
+func findConsumer(config *FullConfig, environment *Environment, name string) (ConsumerConfig, error) {
+	for _, consumer := range config.KafkaConsumers {
+		if consumer.Name == name {
+			return consumer.Resolve(environment.Kafka), nil
+		}
+	}
+	return ConsumerConfig{}, fmt.Errorf("unknown consumer: %s", name)
+}
+
+// consumerTopics returns the consumer's static topics plus the topics that
+// currently match its topic_pattern
+func consumerTopics(consumer ConsumerConfig) ([]string, error) {
+	if consumer.TopicPattern == "" {
+		return resolveTopics(consumer, nil, nil), nil
+	}
+	pattern, err := compileTopicPattern(consumer.TopicPattern)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(consumer.KafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient(client)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	available, err := listTopics(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+	return resolveTopics(consumer, pattern, available), nil
+}
+
+// clampOffset keeps an offset within the partition's available range
+func clampOffset(offset int64, mark watermarks) int64 {
+	if offset < mark.First {
+		return mark.First
+	}
+	if offset > mark.Last {
+		return mark.Last
+	}
+	return offset
+}
+
+func formatOffset(offset int64) string {
+	if offset < 0 {
+		return "-"
+	}
+	return strconv.FormatInt(offset, 10)
+}
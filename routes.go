@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// route is a RouteConfig bound to its handler
+type route struct {
+	name   string
+	match  RouteMatch
+	config ConsumerConfig
+	handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error
+	close  func() error
+}
+
+// isDefault reports whether the route matches every message
+func (m RouteMatch) isDefault() bool {
+	return len(m.Headers) == 0 && m.Key == "" && len(m.Fields) == 0
+}
+
+// consumerRoutes returns the consumer's routes in matching order. The
+// consumer's own handler_name, when set, becomes a default route after them.
+func consumerRoutes(config ConsumerConfig) []RouteConfig {
+	routes := append([]RouteConfig{}, config.Routes...)
+	if config.HandlerName != "" {
+		routes = append(routes, RouteConfig{Name: "default", HandlerName: config.HandlerName, Settings: config.Settings})
+	}
+	return routes
+}
+
+// newRouter binds every route of the consumer to its handler and returns a
+// handler that passes each message to the first matching route. Messages that
+// match no route are skipped.
+func newRouter(config ConsumerConfig, deps HandlerDeps, dedup bool) (handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error, close func() error, err error) {
+	var routes []route
+	closeRoutes := func() error {
+		var errs []error
+		for _, r := range routes {
+			errs = append(errs, r.close())
+		}
+		return errors.Join(errs...)
+	}
+
+	for i, routeConfig := range consumerRoutes(config) {
+		name := routeConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("routes[%d]", i)
+		}
+		handlerConfig := config.withHandler(routeConfig.HandlerName, routeConfig.Settings)
+
+		routeHandle, routeClose, err := newMessageHandler(handlerConfig, deps, dedup)
+		if err != nil {
+			closeRoutes()
+			return nil, nil, fmt.Errorf("route %s: %w", name, err)
+		}
+		routes = append(routes, route{name: name, match: routeConfig.When, config: handlerConfig, handle: routeHandle, close: routeClose})
+	}
+
+	handle = func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+		var payload interface{}
+		var decoded bool
+		for _, r := range routes {
+			if len(r.match.Fields) > 0 && !decoded {
+				if err := json.Unmarshal(message.Value, &payload); err != nil {
+					payload = nil
+				}
+				decoded = true
+			}
+			if r.match.matches(message, payload) {
+				logFunc("DEBUG", "Message %s matched route %s", describeMessage(message), r.name)
+				trace.SpanFromContext(ctx).SetAttributes(attribute.String("multiconsumer.route", r.name), attribute.String("multiconsumer.handler", r.config.HandlerName))
+				return r.handle(ctx, message, r.config, logFunc)
+			}
+		}
+		logFunc("DEBUG", "Message %s matched no route", describeMessage(message))
+		return ErrSkipMessage
+	}
+	return handle, closeRoutes, nil
+}
+
+// matches reports whether a message meets every condition of the route. payload
+// is the decoded JSON value, or nil when the value is not JSON.
+func (m RouteMatch) matches(message kafka.Message, payload interface{}) bool {
+	if m.Key != "" && string(message.Key) != m.Key {
+		return false
+	}
+	for name, want := range m.Headers {
+		found := false
+		for _, header := range message.Headers {
+			if header.Key == name && string(header.Value) == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for path, want := range m.Fields {
+		value, ok := payloadField(payload, path)
+		if !ok || !reflect.DeepEqual(value, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// payloadField looks up a dotted path such as "order.id" in a decoded JSON value
+func payloadField(payload interface{}, path string) (interface{}, bool) {
+	for _, field := range strings.Split(path, ".") {
+		object, ok := payload.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if payload, ok = object[field]; !ok {
+			return nil, false
+		}
+	}
+	return payload, true
+}
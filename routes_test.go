@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestRouteMatch(t *testing.T) {
+	message := kafka.Message{
+		Key:     []byte("order-7"),
+		Value:   []byte(`{"type": "created", "order": {"id": 7, "express": true}}`),
+		Headers: []kafka.Header{{Key: "source", Value: []byte("web")}, {Key: "version", Value: []byte("2")}},
+	}
+	tests := []struct {
+		name  string
+		match RouteMatch
+		want  bool
+	}{
+		{name: "no conditions", match: RouteMatch{}, want: true},
+		{name: "key", match: RouteMatch{Key: "order-7"}, want: true},
+		{name: "other key", match: RouteMatch{Key: "order-8"}, want: false},
+		{name: "header", match: RouteMatch{Headers: map[string]string{"source": "web"}}, want: true},
+		{name: "several headers", match: RouteMatch{Headers: map[string]string{"source": "web", "version": "2"}}, want: true},
+		{name: "header value differs", match: RouteMatch{Headers: map[string]string{"source": "mobile"}}, want: false},
+		{name: "missing header", match: RouteMatch{Headers: map[string]string{"tenant": "acme"}}, want: false},
+		{name: "field", match: RouteMatch{Fields: map[string]interface{}{"type": "created"}}, want: true},
+		{name: "nested fields", match: RouteMatch{Fields: map[string]interface{}{"order.id": float64(7), "order.express": true}}, want: true},
+		{name: "field value differs", match: RouteMatch{Fields: map[string]interface{}{"type": "cancelled"}}, want: false},
+		{name: "missing field", match: RouteMatch{Fields: map[string]interface{}{"order.customer": "acme"}}, want: false},
+		{name: "path through a scalar", match: RouteMatch{Fields: map[string]interface{}{"type.name": "created"}}, want: false},
+		{name: "all conditions", match: RouteMatch{Key: "order-7", Headers: map[string]string{"source": "web"}, Fields: map[string]interface{}{"type": "created"}}, want: true},
+		{name: "one condition fails", match: RouteMatch{Key: "order-7", Headers: map[string]string{"source": "web"}, Fields: map[string]interface{}{"type": "updated"}}, want: false},
+	}
+	var payload interface{}
+	if err := json.Unmarshal(message.Value, &payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.match.matches(message, payload); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteMatchNotJSON(t *testing.T) {
+	message := kafka.Message{Key: []byte("k"), Value: []byte("plain text")}
+	if (RouteMatch{Fields: map[string]interface{}{"type": "created"}}).matches(message, nil) {
+		t.Error("a field condition matched a value that is not JSON")
+	}
+	if !(RouteMatch{Key: "k"}).matches(message, nil) {
+		t.Error("a key condition did not match a value that is not JSON")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	var handled []string
+	for _, name := range []string{"test_route_a", "test_route_b", "test_route_default"} {
+		name := name
+		registerTestHandler(t, name, func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{}), deps HandlerDeps) error {
+			handled = append(handled, name)
+			return nil
+		})
+	}
+	routes := []RouteConfig{
+		{Name: "web orders", When: RouteMatch{Headers: map[string]string{"source": "web"}, Fields: map[string]interface{}{"type": "created"}}, HandlerName: "test_route_a"},
+		{Name: "created", When: RouteMatch{Fields: map[string]interface{}{"type": "created"}}, HandlerName: "test_route_b"},
+		{Name: "web", When: RouteMatch{Headers: map[string]string{"source": "web"}}, HandlerName: "test_route_b"},
+	}
+	web := []kafka.Header{{Key: "source", Value: []byte("web")}}
+
+	tests := []struct {
+		name        string
+		handlerName string // the consumer's own handler, the default route
+		message     kafka.Message
+		want        string // handler that gets the message, empty when skipped
+	}{
+		{name: "first matching route wins", message: kafka.Message{Value: []byte(`{"type": "created"}`), Headers: web}, want: "test_route_a"},
+		{name: "later route", message: kafka.Message{Value: []byte(`{"type": "created"}`)}, want: "test_route_b"},
+		{name: "value that is not JSON", message: kafka.Message{Value: []byte("created"), Headers: web}, want: "test_route_b"},
+		{name: "no match is skipped", message: kafka.Message{Value: []byte(`{"type": "updated"}`)}},
+		{name: "no match goes to the default route", handlerName: "test_route_default", message: kafka.Message{Value: []byte(`{"type": "updated"}`)}, want: "test_route_default"},
+		{name: "routes before the default route", handlerName: "test_route_default", message: kafka.Message{Value: []byte(`{"type": "created"}`)}, want: "test_route_b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			config := ConsumerConfig{Name: "test-router", Routes: routes, HandlerName: tt.handlerName}
+			handle, closeRoutes, err := newRouter(config, HandlerDeps{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeRoutes()
+
+			err = handle(context.Background(), tt.message, config, discardLog)
+			if tt.want == "" {
+				if !errors.Is(err, ErrSkipMessage) || len(handled) != 0 {
+					t.Errorf("error = %v and handled by %v, want ErrSkipMessage", err, handled)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(handled) != 1 || handled[0] != tt.want {
+				t.Errorf("handled by %v, want %s", handled, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretProvider resolves the reference part of a ${provider:reference} value.
+// Implementations for vaults are registered with RegisterSecretProvider.
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretProviderFunc adapts a plain function to a SecretProvider
+type SecretProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"env":  SecretProviderFunc(resolveEnvSecret),
+		"file": SecretProviderFunc(resolveFileSecret),
+	}
+)
+
+// RegisterSecretProvider makes a provider available as ${name:reference} in config values
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[name] = provider
+}
+
+func resolveEnvSecret(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+func resolveFileSecret(ctx context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+var secretRefPattern = regexp.MustCompile(`\$\{([A-Za-z][\w-]*):([^}]*)\}`)
+
+// resolveSecretString replaces every ${provider:reference} in value with the
+// resolved secret and records the secret for redaction
+func resolveSecretString(value string) (string, error) {
+	var errs []error
+	resolved := secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		parts := secretRefPattern.FindStringSubmatch(ref)
+		secretProvidersMu.RLock()
+		provider, ok := secretProviders[parts[1]]
+		secretProvidersMu.RUnlock()
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown secret provider %q", ref, parts[1]))
+			return ref
+		}
+		secret, err := provider.Resolve(context.Background(), parts[2])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ref, err))
+			return ref
+		}
+		secretRedactor.add(secret)
+		return secret
+	})
+	return resolved, errors.Join(errs...)
+}
+
+// anchorFileSecrets rewrites every relative ${file:path} reference in a config
+// tree read from a file in dir so that the path is read from dir, whatever the
+// working directory
+func anchorFileSecrets(tree interface{}, dir string) interface{} {
+	switch value := tree.(type) {
+	case string:
+		return secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+			parts := secretRefPattern.FindStringSubmatch(ref)
+			if parts[1] != "file" || parts[2] == "" || filepath.IsAbs(parts[2]) {
+				return ref
+			}
+			return "${file:" + filepath.Join(dir, parts[2]) + "}"
+		})
+	case map[string]interface{}:
+		for key, child := range value {
+			value[key] = anchorFileSecrets(child, dir)
+		}
+		return value
+	case []interface{}:
+		for i, child := range value {
+			value[i] = anchorFileSecrets(child, dir)
+		}
+		return value
+	default:
+		return tree
+	}
+}
+
+// resolveSecrets walks a decoded JSON tree and resolves secret references in
+// every string. Keys listed in skip are left untouched at the top level.
+func resolveSecrets(tree interface{}, path string, skip map[string]bool) (interface{}, error) {
+	switch value := tree.(type) {
+	case string:
+		resolved, err := resolveSecretString(value)
+		if err != nil {
+			return value, fmt.Errorf("%s: %w", path, err)
+		}
+		return resolved, nil
+	case map[string]interface{}:
+		var errs []error
+		for key, child := range value {
+			if skip[key] {
+				continue
+			}
+			resolved, err := resolveSecrets(child, joinPath(path, key), nil)
+			errs = append(errs, err)
+			value[key] = resolved
+		}
+		return value, errors.Join(errs...)
+	case []interface{}:
+		var errs []error
+		for i, child := range value {
+			resolved, err := resolveSecrets(child, fmt.Sprintf("%s[%d]", path, i), nil)
+			errs = append(errs, err)
+			value[i] = resolved
+		}
+		return value, errors.Join(errs...)
+	default:
+		return tree, nil
+	}
+}
+
+// joinPath appends a key to a dotted JSON path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// secretRedactor remembers every resolved secret so it can be masked in output
+var secretRedactor = &redactor{}
+
+type redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// minRedactedLength is the shortest secret that is masked in output; shorter
+// values would mask unrelated text wherever the same characters appear
+const minRedactedLength = 4
+
+func (r *redactor) add(secret string) {
+	if len(secret) < minRedactedLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secrets == nil {
+		r.secrets = make(map[string]bool)
+	}
+	if r.secrets[secret] {
+		return
+	}
+	r.secrets[secret] = true
+
+	// Replace longer secrets first so one secret containing another is fully masked
+	values := make([]string, 0, len(r.secrets))
+	for value := range r.secrets {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "****")
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redactSecrets masks every resolved secret in s
+func redactSecrets(s string) string {
+	secretRedactor.mu.RLock()
+	defer secretRedactor.mu.RUnlock()
+	if secretRedactor.replacer == nil {
+		return s
+	}
+	return secretRedactor.replacer.Replace(s)
+}
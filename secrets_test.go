@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecretString(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MC_TEST_SECRET", "env-secret")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		err   string
+	}{
+		{name: "plain value", value: "localhost", want: "localhost"},
+		{name: "env", value: "${env:MC_TEST_SECRET}", want: "env-secret"},
+		{name: "file without trailing newline", value: "${file:" + filepath.Join(dir, "password") + "}", want: "file-secret"},
+		{name: "several references", value: "user:${env:MC_TEST_SECRET}@${file:" + filepath.Join(dir, "password") + "}", want: "user:env-secret@file-secret"},
+		{name: "not a reference", value: "${MC_TEST_SECRET}", want: "${MC_TEST_SECRET}"},
+		{name: "unknown provider", value: "${vault:secret/mysql}", err: `${vault:secret/mysql}: unknown secret provider "vault"`},
+		{name: "missing variable", value: "${env:MC_TEST_MISSING}", err: "${env:MC_TEST_MISSING}: environment variable MC_TEST_MISSING is not set"},
+		{name: "missing file", value: "${file:" + filepath.Join(dir, "missing") + "}", err: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSecretString(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveSecretString(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnchorFileSecrets(t *testing.T) {
+	dir := filepath.FromSlash("/etc/multiconsumer")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "${file:secrets/mongo_password}", want: "${file:" + filepath.Join(dir, "secrets/mongo_password") + "}"},
+		{value: "${file:/run/secrets/mongo_password}", want: "${file:/run/secrets/mongo_password}"},
+		{value: "${env:MONGO_PASSWORD}", want: "${env:MONGO_PASSWORD}"},
+		{value: "secrets/mongo_password", want: "secrets/mongo_password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			tree := map[string]interface{}{"mongo": map[string]interface{}{"development": []interface{}{tt.value}}}
+			anchorFileSecrets(tree, dir)
+			got := tree["mongo"].(map[string]interface{})["development"].([]interface{})[0]
+			if got != tt.want {
+				t.Errorf("anchored = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	dir := t.TempDir()
+	const secret = "s3cr3t-mysql-password"
+	if err := os.MkdirAll(filepath.Join(dir, "secrets"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secrets", "mysql_password"), []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configFile, []byte(`{
+		"mysql": {"development": {"host": "localhost", "user": "dev", "password": "${file:secrets/mysql_password}"}},
+		"kafkaConsumers": []
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ReadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	environment, err := GetEnvConfig("development", *config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if environment.MySQL.Password != secret {
+		t.Fatalf("password = %q, want the file's content", environment.MySQL.Password)
+	}
+
+	// Startup output
+	if output := redactSecrets(fmt.Sprintf("MySQL Config: %+v\n", environment.MySQL)); strings.Contains(output, secret) || !strings.Contains(output, "****") {
+		t.Errorf("formatted config shows the secret: %s", output)
+	}
+
+	// Log files
+	logFile, err := os.CreateTemp(dir, "consumer-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	logger := customLogger("test", logFile, true)
+	logger("INFO", "Connecting with %+v", environment.MySQL)
+	logger("ERROR", "Login failed for password "+secret)
+	data, err := os.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) || strings.Count(string(data), "****") != 2 {
+		t.Errorf("log shows the secret:\n%s", data)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// defaultTopicRefreshInterval is how often topic_pattern is matched against the
+// broker metadata when topic_refresh_interval is not set
+const defaultTopicRefreshInterval = 30 * time.Second
+
+// StaticTopics returns the topics named in "topic" and "topics"
+func (c ConsumerConfig) StaticTopics() []string {
+	var topics []string
+	if c.Topic != "" {
+		topics = append(topics, c.Topic)
+	}
+	return appendUnique(topics, c.Topics...)
+}
+
+// compileTopicPattern compiles topic_pattern so that it must match a whole topic name
+func compileTopicPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// listTopics returns the names of all non-internal topics known to the brokers
+func listTopics(ctx context.Context, client *kafka.Client) ([]string, error) {
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var topics []string
+	for _, topic := range metadata.Topics {
+		if topic.Error == nil && !topic.Internal && !strings.HasPrefix(topic.Name, "__") {
+			topics = append(topics, topic.Name)
+		}
+	}
+	return topics, nil
+}
+
+// resolveTopics returns the consumer's static topics plus every available topic
+// matching its pattern, sorted
+func resolveTopics(config ConsumerConfig, pattern *regexp.Regexp, available []string) []string {
+	topics := config.StaticTopics()
+	if pattern != nil {
+		for _, topic := range available {
+			if pattern.MatchString(topic) {
+				topics = appendUnique(topics, topic)
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// setTopics records the topics the consumer should read. When they differ from
+// the current subscription, the current fetch is interrupted so that Start
+// joins the group again with the new topics.
+func (kc *KafkaConsumer) setTopics(topics []string) {
+	kc.topicsMu.Lock()
+	defer kc.topicsMu.Unlock()
+	if strings.Join(topics, ",") == strings.Join(kc.topics, ",") {
+		return
+	}
+	kc.topics = topics
+	if kc.fetchCancel != nil {
+		kc.fetchCancel()
+	}
+}
+
+// subscription returns the current topics and a fresh context for fetching
+// from them, which setTopics cancels on change
+func (kc *KafkaConsumer) subscription() ([]string, context.Context) {
+	kc.topicsMu.Lock()
+	defer kc.topicsMu.Unlock()
+	if kc.fetchCancel != nil {
+		kc.fetchCancel()
+	}
+	var fetchCtx context.Context
+	fetchCtx, kc.fetchCancel = context.WithCancel(kc.ctx)
+	return kc.topics, fetchCtx
+}
+
+// watchTopics periodically matches topic_pattern against the broker metadata
+// and updates the subscription when topics appear or disappear
+func (kc *KafkaConsumer) watchTopics(pattern *regexp.Regexp) {
+	interval := time.Duration(kc.consumerConfig.TopicRefreshInterval)
+	if interval <= 0 {
+		interval = defaultTopicRefreshInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		available, err := listTopics(kc.ctx, kc.client)
+		if err != nil {
+			if kc.ctx.Err() != nil {
+				return
+			}
+			kc.logger("WARNING", "Failed to list topics for pattern %s: %v", kc.consumerConfig.TopicPattern, err)
+		} else {
+			topics := resolveTopics(kc.consumerConfig, pattern, available)
+			kc.logger("DEBUG", "Topics matching pattern %s: %s", kc.consumerConfig.TopicPattern, strings.Join(topics, ","))
+			kc.setTopics(topics)
+		}
+
+		select {
+		case <-kc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// describeTopics formats a topic list for log messages
+func describeTopics(topics []string) string {
+	if len(topics) == 0 {
+		return "(none)"
+	}
+	return fmt.Sprintf("[%s]", strings.Join(topics, ", "))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestCompileTopicPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{pattern: "orders-.*", topic: "orders-eu", want: true},
+		{pattern: "orders-.*", topic: "legacy-orders-eu", want: false},
+		{pattern: "orders", topic: "orders-eu", want: false},
+		{pattern: "orders|refunds", topic: "refunds", want: true},
+		{pattern: "orders|refunds", topic: "orders-refunds", want: false},
+		{pattern: "orders-(eu|us)", topic: "orders-us", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.topic, func(t *testing.T) {
+			pattern, err := compileTopicPattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pattern.MatchString(tt.topic); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := compileTopicPattern("orders-(["); err == nil {
+		t.Error("an invalid pattern compiled")
+	}
+}
+
+func TestResolveTopics(t *testing.T) {
+	available := []string{"orders-us", "refunds", "orders-eu", "orders"}
+	tests := []struct {
+		name    string
+		config  ConsumerConfig
+		pattern string
+		want    []string
+	}{
+		{name: "topic", config: ConsumerConfig{Topic: "orders"}, want: []string{"orders"}},
+		{name: "topics sorted", config: ConsumerConfig{Topic: "refunds", Topics: []string{"orders", "refunds"}}, want: []string{"orders", "refunds"}},
+		{name: "pattern", pattern: "orders-.*", want: []string{"orders-eu", "orders-us"}},
+		{name: "pattern and static topics", config: ConsumerConfig{Topics: []string{"audit", "orders-eu"}}, pattern: "orders-.*", want: []string{"audit", "orders-eu", "orders-us"}},
+		{name: "pattern matching nothing", pattern: "payments-.*"},
+		{name: "static topics need not exist", config: ConsumerConfig{Topic: "audit"}, want: []string{"audit"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pattern *regexp.Regexp
+			if tt.pattern != "" {
+				var err error
+				if pattern, err = compileTopicPattern(tt.pattern); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := resolveTopics(tt.config, pattern, available); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveTopics() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing exporters and OTLP protocols; see TracingConfig
+const (
+	tracingOTLP   = "otlp"
+	tracingStdout = "stdout"
+	tracingFile   = "file"
+
+	otlpHTTP = "http/protobuf"
+	otlpGRPC = "grpc"
+)
+
+const defaultServiceName = "multiconsumer"
+
+// tracer creates the spans of the consumers. It uses the provider set by
+// startTracing and does nothing until then.
+var tracer = otel.Tracer("multiconsumer")
+
+// propagator reads and writes W3C trace context and baggage in message headers.
+// It is set even without an exporter, so that the trace context of consumed
+// messages still reaches the messages published while handling them.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func init() {
+	otel.SetTextMapPropagator(propagator)
+}
+
+// headerCarrier adapts the headers of a Kafka message for the propagator.
+// Set replaces a header of the same key, e.g. the traceparent of a forwarded
+// source message.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for _, header := range *c.headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	headers := (*c.headers)[:0:0]
+	for _, header := range *c.headers {
+		if header.Key != key {
+			headers = append(headers, header)
+		}
+	}
+	*c.headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, len(*c.headers))
+	for i, header := range *c.headers {
+		keys[i] = header.Key
+	}
+	return keys
+}
+
+// startTracing sets up the configured exporter and returns the function that
+// flushes the remaining spans on shutdown. Without an exporter spans are not
+// recorded and shutdown does nothing.
+func startTracing(config TracingConfig) (shutdown func(ctx context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	var file io.Closer
+	switch config.Exporter {
+	case "":
+		return func(ctx context.Context) error { return nil }, nil
+	case tracingOTLP:
+		exporter, err = newOTLPExporter(config)
+	case tracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case tracingFile:
+		var f *os.File
+		if f, err = os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666); err != nil {
+			return nil, err
+		}
+		file = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampleRatio := 1.0
+	if config.SampleRatio != nil {
+		sampleRatio = *config.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		// Follow the sampling decision of the publisher when the message carries one
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+func newOTLPExporter(config TracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	switch config.Protocol {
+	case "", otlpHTTP:
+		options := []otlptracehttp.Option{otlptracehttp.WithHeaders(config.Headers)}
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, options...)
+	case otlpGRPC:
+		options := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(config.Headers)}
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpointURL(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", config.Protocol)
+	}
+}
+
+// stopTracing flushes the spans not exported yet
+func stopTracing(shutdown func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return shutdown(ctx)
+}
+
+// startMessageSpan starts the consumer span of a message, as a child of the
+// trace context found in its headers
+func (kc *KafkaConsumer) startMessageSpan(ctx context.Context, message kafka.Message) (context.Context, trace.Span) {
+	ctx = propagator.Extract(ctx, headerCarrier{&message.Headers})
+	return tracer.Start(ctx, "process "+message.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.operation.type", "process"),
+			attribute.String("messaging.destination.name", message.Topic),
+			attribute.String("messaging.destination.partition.id", strconv.Itoa(message.Partition)),
+			attribute.Int64("messaging.kafka.offset", message.Offset),
+			attribute.String("messaging.kafka.message.key", string(message.Key)),
+			attribute.String("messaging.consumer.group.name", kc.consumerConfig.GroupID),
+			attribute.String("multiconsumer.consumer", kc.consumerConfig.Name),
+			attribute.String("multiconsumer.handler", kc.consumerConfig.HandlerName),
+		),
+	)
+}
+
+// endMessageSpan records the outcome of the last handler call and ends the span
+func endMessageSpan(span trace.Span, attempts int, err error) {
+	span.SetAttributes(attribute.Int("multiconsumer.attempts", attempts))
+	switch {
+	case errors.Is(err, ErrSkipMessage):
+		span.SetAttributes(attribute.Bool("multiconsumer.skipped", true))
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHeaderCarrierRoundTrip(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+	member, _ := baggage.NewMember("tenant", "acme")
+	bag, _ := baggage.New(member)
+	ctx := baggage.ContextWithBaggage(trace.ContextWithSpanContext(context.Background(), spanContext), bag)
+
+	// Headers of a consumed message that is forwarded: its trace context is replaced
+	headers := []kafka.Header{
+		{Key: "traceparent", Value: []byte("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")},
+		{Key: "content-type", Value: []byte("application/json")},
+	}
+	propagator.Inject(ctx, headerCarrier{&headers})
+
+	counts := make(map[string]int)
+	for _, key := range (headerCarrier{&headers}).Keys() {
+		counts[key]++
+	}
+	if counts["traceparent"] != 1 || counts["baggage"] != 1 || counts["content-type"] != 1 {
+		t.Errorf("headers %v, want traceparent and baggage once, next to content-type", counts)
+	}
+	carrier := headerCarrier{&headers}
+	if got, want := carrier.Get("traceparent"), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+	if got := carrier.Get("content-type"); got != "application/json" {
+		t.Errorf("content-type = %q, want it kept", got)
+	}
+
+	extracted := propagator.Extract(context.Background(), headerCarrier{&headers})
+	got := trace.SpanContextFromContext(extracted)
+	if got.TraceID() != traceID || got.SpanID() != spanID || !got.IsSampled() || !got.IsRemote() {
+		t.Errorf("extracted span context %+v, want trace %s span %s sampled and remote", got, traceID, spanID)
+	}
+	if value := baggage.FromContext(extracted).Member("tenant").Value(); value != "acme" {
+		t.Errorf("baggage tenant = %q, want acme", value)
+	}
+}
+
+func TestHeaderCarrierSet(t *testing.T) {
+	source := []kafka.Header{{Key: "traceparent", Value: []byte("old")}, {Key: "key", Value: []byte("a")}, {Key: "traceparent", Value: []byte("older")}}
+	headers := source
+	carrier := headerCarrier{&headers}
+	carrier.Set("traceparent", "new")
+
+	var values []string
+	for _, header := range headers {
+		if header.Key == "traceparent" {
+			values = append(values, string(header.Value))
+		}
+	}
+	if len(values) != 1 || values[0] != "new" {
+		t.Errorf("traceparent headers %q, want only the new one", values)
+	}
+	if carrier.Get("key") != "a" {
+		t.Error("other headers were dropped")
+	}
+	// The source message's headers are left alone
+	if string(source[0].Value) != "old" || len(source) != 3 {
+		t.Errorf("source headers changed to %v", source)
+	}
+	if carrier.Get("missing") != "" {
+		t.Error("Get returned a value for a missing header")
+	}
+}
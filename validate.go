@@ -0,0 +1,723 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ValidationError is a single configuration problem located by its JSON path
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors collects every problem found in a configuration
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// SettingsSchema describes the keys a handler accepts in a consumer's "settings".
+// A nil schema accepts anything; an empty one accepts no settings at all.
+type SettingsSchema map[string]SettingSpec
+
+// SettingSpec describes one setting. Type is one of "string", "number", "bool",
+// "object", "array" or "any". Fields describes the keys of an object and Items
+// the elements of an array.
+type SettingSpec struct {
+	Type     string
+	Required bool
+	Fields   SettingsSchema
+	Items    *SettingSpec
+}
+
+func (s SettingsSchema) validate(settings map[string]interface{}, path string, errs *ValidationErrors) {
+	if s == nil {
+		return
+	}
+	for _, key := range sortedKeys(s) {
+		if _, ok := settings[key]; !ok && s[key].Required {
+			errs.add(joinPath(path, key), "required setting is missing")
+		}
+	}
+	for _, key := range sortedKeys(settings) {
+		value := settings[key]
+		spec, ok := s[key]
+		if !ok {
+			errs.add(joinPath(path, key), "unknown setting")
+			continue
+		}
+		spec.validate(value, joinPath(path, key), errs)
+	}
+}
+
+func (s SettingSpec) validate(value interface{}, path string, errs *ValidationErrors) {
+	switch s.Type {
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs.add(path, "expected a string, got %s", jsonType(value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs.add(path, "expected a number, got %s", jsonType(value))
+		}
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			errs.add(path, "expected a boolean, got %s", jsonType(value))
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(path, "expected an object, got %s", jsonType(value))
+			return
+		}
+		s.Fields.validate(object, path, errs)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.add(path, "expected an array, got %s", jsonType(value))
+			return
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of a map in order, for stable error output
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonType names the JSON type of a decoded value for error messages
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// ValidateConfig checks the configuration for the given environment and
+// returns every problem found. Each section has its own validator.
+func ValidateConfig(config *FullConfig, env string) ValidationErrors {
+	errs, kafkaEnv, redisEnv := validateEnvironments(config, env)
+	errs = append(errs, validateProducer(config.Producer)...)
+	errs = append(errs, validateAdmin(config.Admin)...)
+	errs = append(errs, validateTracing(config.Tracing)...)
+	errs = append(errs, validateSinks(config.Sinks)...)
+	errs = append(errs, validateConsumers(config, env, kafkaEnv, redisEnv)...)
+	return errs
+}
+
+// validateEnvironments checks the environment inheritance and that every
+// environment-scoped section resolves for env. It also returns the resolved
+// Kafka and Redis settings that the consumers are checked against.
+func validateEnvironments(config *FullConfig, env string) (ValidationErrors, KafkaConfig, RedisConfig) {
+	var errs ValidationErrors
+	known := make(map[string]bool)
+	for _, name := range config.EnvironmentNames() {
+		known[name] = true
+	}
+	for _, name := range sortedKeys(config.Environments) {
+		if def := config.Environments[name]; def.Extends != "" && !known[def.Extends] {
+			errs.add(joinPath("environments", name)+".extends", "unknown environment %q", def.Extends)
+		}
+	}
+
+	var kafkaEnv KafkaConfig
+	var redisEnv RedisConfig
+	chain, err := config.environmentChain(env)
+	if err != nil {
+		errs.add("environments", "%v", err)
+		return errs, kafkaEnv, redisEnv
+	}
+	for _, named := range config.envSections() {
+		if _, err := named.section.resolveEnv(chain); err != nil {
+			errs.add(joinPath(named.key, env), "%v", err)
+		}
+	}
+	kafkaEnv, _ = config.Kafka.Resolve(chain)
+	redisEnv, _ = config.Redis.Resolve(chain)
+	return errs, kafkaEnv, redisEnv
+}
+
+// validateProducer checks the producer defaults and per-topic settings
+func validateProducer(producer ProducerConfig) ValidationErrors {
+	var errs ValidationErrors
+	check := func(path string, settings TopicProducerConfig) {
+		if _, err := newTopicWriter(settings); err != nil {
+			errs.add(path, "%v", err)
+		}
+		if settings.BatchSize < 0 || settings.BatchBytes < 0 || settings.BatchTimeout < 0 {
+			errs.add(path, "batch settings must not be negative")
+		}
+	}
+	check("producer.defaults", producer.Defaults)
+	for _, topic := range sortedKeys(producer.Topics) {
+		check(joinPath("producer.topics", topic), producer.Topics[topic])
+	}
+	return errs
+}
+
+// validateAdmin checks the listen address of the admin server
+func validateAdmin(admin AdminConfig) ValidationErrors {
+	var errs ValidationErrors
+	if admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(admin.Listen); err != nil {
+			errs.add("admin.listen", "invalid address %q: %v", admin.Listen, err)
+		}
+	}
+	return errs
+}
+
+// validateTracing checks the exporter settings
+func validateTracing(tracing TracingConfig) ValidationErrors {
+	var errs ValidationErrors
+	switch tracing.Exporter {
+	case "", tracingStdout:
+	case tracingOTLP:
+		switch tracing.Protocol {
+		case "", otlpHTTP, otlpGRPC:
+		default:
+			errs.add("tracing.protocol", "unknown protocol %q (available: %s, %s)", tracing.Protocol, otlpHTTP, otlpGRPC)
+		}
+		if tracing.Endpoint != "" {
+			if endpoint, err := url.Parse(tracing.Endpoint); err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+				errs.add("tracing.endpoint", "must be a URL such as http://localhost:4318")
+			}
+		}
+	case tracingFile:
+		if tracing.Path == "" {
+			errs.add("tracing.path", "required for the file exporter")
+		}
+	default:
+		errs.add("tracing.exporter", "unknown exporter %q (available: otlp, stdout, file)", tracing.Exporter)
+	}
+	if ratio := tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		errs.add("tracing.sample_ratio", "must be between 0 and 1")
+	}
+	return errs
+}
+
+// validateSinks checks the shared rate limits and circuit breakers of the sinks
+func validateSinks(sinks map[string]SinkConfig) ValidationErrors {
+	var errs ValidationErrors
+	for _, name := range sortedKeys(sinks) {
+		sink := sinks[name]
+		if sink.MessagesPerSecond < 0 || sink.BytesPerSecond < 0 {
+			errs.add(joinPath("sinks", name), "rates must not be negative")
+		}
+		if sink.CircuitBreaker != nil {
+			errs = append(errs, validateCircuitBreaker(*sink.CircuitBreaker, joinPath("sinks", name)+".circuit_breaker")...)
+		}
+	}
+	return errs
+}
+
+// validateConsumers checks every consumer, and the names and group/topic pairs
+// that must be unique across them
+func validateConsumers(config *FullConfig, env string, kafkaEnv KafkaConfig, redisEnv RedisConfig) ValidationErrors {
+	var errs ValidationErrors
+	if len(config.KafkaConsumers) == 0 {
+		errs.add("kafkaConsumers", "no consumers configured")
+	}
+
+	seen := make(map[string]int)
+	names := make(map[string]int)
+	for i, consumer := range config.KafkaConsumers {
+		path := fmt.Sprintf("kafkaConsumers[%d]", i)
+		resolved := consumer.Resolve(kafkaEnv)
+
+		if consumer.Name == "" {
+			errs.add(path+".name", "required field is missing")
+		} else if !consumerNamePattern.MatchString(consumer.Name) {
+			errs.add(path+".name", "%q may only contain letters, digits, '_', '-' and '.'", consumer.Name)
+		} else if first, ok := names[consumer.Name]; ok {
+			errs.add(path+".name", "%q is already used by kafkaConsumers[%d]", consumer.Name, first)
+		} else {
+			names[consumer.Name] = i
+		}
+		if consumer.GroupID == "" {
+			errs.add(path+".group_id", "required field is missing")
+		}
+		if consumer.LogFile == "" {
+			errs.add(path+".log_file", "required field is missing")
+		}
+		for _, topic := range consumer.StaticTopics() {
+			if consumer.GroupID == "" {
+				break
+			}
+			key := resolved.GroupID + "\x00" + topic
+			if first, ok := seen[key]; ok {
+				errs.add(path, "group_id %q and topic %q are already used by kafkaConsumers[%d]", resolved.GroupID, topic, first)
+			} else {
+				seen[key] = i
+			}
+		}
+
+		errs = append(errs, validateTopics(consumer, path)...)
+		errs = append(errs, validateStartOffset(consumer.StartOffset, path)...)
+		errs = append(errs, validateKafka(resolved, path, env)...)
+		errs = append(errs, validateHandlers(consumer, path)...)
+		errs = append(errs, validateProducerCluster(consumer, resolved, kafkaEnv, path)...)
+		errs = append(errs, validateDedup(consumer.Dedup, path, env, redisEnv)...)
+		errs = append(errs, validateRateLimit(consumer, path, config.Sinks)...)
+		if consumer.CircuitBreaker != nil {
+			errs = append(errs, validateCircuitBreaker(*consumer.CircuitBreaker, path+".circuit_breaker")...)
+		}
+		errs = append(errs, validateFailures(consumer, path)...)
+		errs = append(errs, validateLag(consumer.Lag, path)...)
+	}
+	return errs
+}
+
+// validateTopics checks what the consumer subscribes to
+func validateTopics(consumer ConsumerConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	if len(consumer.StaticTopics()) == 0 && consumer.TopicPattern == "" {
+		errs.add(path+".topic", "one of topic, topics or topic_pattern is required")
+	}
+	for j, topic := range consumer.Topics {
+		if topic == "" {
+			errs.add(fmt.Sprintf("%s.topics[%d]", path, j), "topic name is empty")
+		}
+	}
+	if consumer.TopicPattern != "" {
+		if _, err := compileTopicPattern(consumer.TopicPattern); err != nil {
+			errs.add(path+".topic_pattern", "invalid regular expression: %v", err)
+		}
+	}
+	if consumer.TopicRefreshInterval < 0 {
+		errs.add(path+".topic_refresh_interval", "must not be negative")
+	}
+	return errs
+}
+
+// validateStartOffset checks the explicit offsets of a start_offset
+func validateStartOffset(startOffset StartOffset, path string) ValidationErrors {
+	var errs ValidationErrors
+	for _, topic := range sortedKeys(startOffset.Partitions) {
+		offsets := startOffset.Partitions[topic]
+		partitions := make([]int, 0, len(offsets))
+		for partition := range offsets {
+			partitions = append(partitions, partition)
+		}
+		sort.Ints(partitions)
+		for _, partition := range partitions {
+			if offset := offsets[partition]; partition < 0 || offset < 0 {
+				errs.add(fmt.Sprintf("%s.start_offset.%s.%d", path, topic, partition), "partitions and offsets must not be negative")
+			}
+		}
+	}
+	return errs
+}
+
+// validateKafka checks the consumer's Kafka settings once layered on the
+// environment's: brokers, tuning, commits, group balancers and security
+func validateKafka(resolved ConsumerConfig, path string, env string) ValidationErrors {
+	var errs ValidationErrors
+	if len(resolved.Brokers) == 0 {
+		errs.add(path+".brokers", "no brokers configured for the consumer or for environment %s", env)
+	}
+	for j, broker := range resolved.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			errs.add(fmt.Sprintf("%s.brokers[%d]", path, j), "invalid broker address %q: %v", broker, err)
+		}
+	}
+	if resolved.MinBytes < 0 {
+		errs.add(path+".min_bytes", "must not be negative")
+	}
+	if resolved.MaxBytes < 0 || (resolved.MaxBytes > 0 && resolved.MaxBytes < resolved.MinBytes) {
+		errs.add(path+".max_bytes", "must be at least min_bytes")
+	}
+	for _, duration := range []struct {
+		field string
+		value Duration
+	}{
+		{"max_wait", resolved.MaxWait},
+		{"session_timeout", resolved.SessionTimeout},
+		{"heartbeat_interval", resolved.HeartbeatInterval},
+		{"rebalance_timeout", resolved.RebalanceTimeout},
+		{"commit_interval", resolved.CommitInterval},
+	} {
+		if duration.value < 0 {
+			errs.add(path+"."+duration.field, "must not be negative")
+		}
+	}
+	if resolved.HeartbeatInterval > 0 && resolved.SessionTimeout > 0 && resolved.HeartbeatInterval >= resolved.SessionTimeout {
+		errs.add(path+".heartbeat_interval", "must be shorter than session_timeout")
+	}
+	if _, ok := isolationLevels[resolved.IsolationLevel]; !ok {
+		errs.add(path+".isolation_level", "unknown isolation level %q (available: read_uncommitted, read_committed)", resolved.IsolationLevel)
+	}
+	if resolved.QueueCapacity < 0 {
+		errs.add(path+".queue_capacity", "must not be negative")
+	}
+	switch resolved.CommitStrategy {
+	case "", commitSync, commitInterval, commitManual:
+	default:
+		errs.add(path+".commit_strategy", "unknown commit strategy %q (available: sync, interval, manual)", resolved.CommitStrategy)
+	}
+	if resolved.CommitMessages < 0 {
+		errs.add(path+".commit_messages", "must not be negative")
+	}
+	for j, name := range resolved.GroupBalancers {
+		if _, ok := groupBalancers[name]; !ok {
+			errs.add(fmt.Sprintf("%s.group_balancers[%d]", path, j), "unknown group balancer %q (available: %s)", name, strings.Join(sortedKeys(groupBalancers), ", "))
+		} else if name == "rack_affinity" && resolved.Rack == "" {
+			errs.add(path+".rack", "required for the rack_affinity group balancer")
+		}
+	}
+	if resolved.Security.SASL.Mechanism != "" {
+		if _, err := newSASLMechanism(resolved.Security.SASL); err != nil {
+			errs.add(path+".security.sasl.mechanism", "%v", err)
+		}
+	}
+	if resolved.Security.TLS.Enabled {
+		if _, err := newTLSConfig(resolved.Security.TLS); err != nil {
+			errs.add(path+".security.tls", "%v", err)
+		}
+	}
+	return errs
+}
+
+// validateHandlers checks the consumer's handler, routes or handlers list and
+// its forward topic
+func validateHandlers(consumer ConsumerConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	routed := len(consumer.Routes) > 0
+	fanOut := len(consumer.Handlers) > 0
+	forwarding := 0
+	validateHandler := func(path, name string, settings map[string]interface{}) {
+		spec, ok := handlerRegistry[name]
+		if !ok {
+			errs.add(path+".handler_name", "unknown handler %q (available: %s)", name, strings.Join(handlerNames(), ", "))
+			return
+		}
+		spec.Settings.validate(settings, path+".settings", &errs)
+		if spec.Transform == nil {
+			return
+		}
+		forwarding++
+		switch {
+		case routed:
+			errs.add(path+".handler_name", "forwarding handler %q cannot be used with routes", name)
+		case consumer.Forward == nil:
+			errs.add(path+".forward", "handler %q forwards messages and requires forward.topic", name)
+		case forwarding > 1:
+			errs.add(path+".handler_name", "only one forwarding handler may write to forward.topic")
+		}
+	}
+	if consumer.HandlerName != "" {
+		validateHandler(path, consumer.HandlerName, consumer.Settings)
+	} else if !routed && !fanOut {
+		errs.add(path+".handler_name", "required field is missing")
+	}
+	if fanOut && (routed || consumer.HandlerName != "") {
+		errs.add(path+".handlers", "handlers cannot be combined with handler_name or routes")
+	}
+	for j, handler := range consumer.Handlers {
+		handlerPath := fmt.Sprintf("%s.handlers[%d]", path, j)
+		if handler.HandlerName == "" {
+			errs.add(handlerPath+".handler_name", "required field is missing")
+		} else {
+			validateHandler(handlerPath, handler.HandlerName, handler.Settings)
+		}
+		switch handler.OnFailure {
+		case "", "block", "retry", "log":
+		default:
+			errs.add(handlerPath+".on_failure", "unknown policy %q (available: block, retry, log)", handler.OnFailure)
+		}
+		if handler.Retries != nil && *handler.Retries < 0 {
+			errs.add(handlerPath+".retries", "must not be negative")
+		}
+		if handler.RetryBackoff < 0 {
+			errs.add(handlerPath+".retry_backoff", "must not be negative")
+		}
+	}
+	switch consumer.Execution {
+	case "", "sequential", "parallel":
+	default:
+		errs.add(path+".execution", "unknown execution %q (available: sequential, parallel)", consumer.Execution)
+	}
+	for j, route := range consumer.Routes {
+		routePath := fmt.Sprintf("%s.routes[%d]", path, j)
+		if route.HandlerName == "" {
+			errs.add(routePath+".handler_name", "required field is missing")
+		} else {
+			validateHandler(routePath, route.HandlerName, route.Settings)
+		}
+		for _, field := range sortedKeys(route.When.Fields) {
+			if strings.Contains("."+field+".", "..") {
+				errs.add(routePath+".when.fields", "empty field name in %q", field)
+			}
+		}
+		if route.When.isDefault() && (j < len(consumer.Routes)-1 || consumer.HandlerName != "") {
+			errs.add(routePath+".when", "a route without conditions matches every message, so the routes after it are never used")
+		}
+	}
+
+	if routed && consumer.Forward != nil {
+		errs.add(path+".forward", "forward cannot be combined with routes")
+	} else if consumer.Forward != nil && forwarding == 0 {
+		errs.add(path+".forward", "no handler of the consumer forwards messages")
+	}
+	if consumer.Forward != nil {
+		if consumer.Forward.Topic == "" {
+			errs.add(path+".forward.topic", "required field is missing")
+		}
+		for _, topic := range consumer.StaticTopics() {
+			if topic == consumer.Forward.Topic {
+				errs.add(path+".forward.topic", "%q is also a source topic of the consumer", topic)
+			}
+		}
+		if consumer.Forward.DedupWindow < 0 {
+			errs.add(path+".forward.dedup_window", "must not be negative")
+		}
+	}
+	return errs
+}
+
+// validateProducerCluster checks that a consumer writing through the shared
+// producer reads from the cluster the producer writes to, which is the
+// environment's. Otherwise the forwarder would look for earlier outputs on one
+// cluster while writing them to another, and dead letters would land on a
+// cluster other than the one their messages came from.
+func validateProducerCluster(consumer ConsumerConfig, resolved ConsumerConfig, env KafkaConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	if slices.Equal(resolved.Brokers, env.Brokers) && resolved.Security == env.Security {
+		return errs
+	}
+	if consumer.Forward != nil {
+		errs.add(path+".forward", "the forward topic is written to the environment's brokers, so the consumer cannot override brokers or security")
+	}
+	if consumer.DeadLetterTopic != "" {
+		errs.add(path+".dead_letter_topic", "the dead letter topic is written to the environment's brokers, so the consumer cannot override brokers or security")
+	}
+	return errs
+}
+
+// validateDedup checks the dedup key and store of a consumer
+func validateDedup(dedup *DedupConfig, path string, env string, redisEnv RedisConfig) ValidationErrors {
+	var errs ValidationErrors
+	if dedup == nil {
+		return errs
+	}
+	if dedup.Key == "" {
+		errs.add(path+".dedup.key", "required field is missing")
+	} else if err := validateDedupKey(dedup.Key); err != nil {
+		errs.add(path+".dedup.key", "%v", err)
+	}
+	if dedup.TTL < 0 {
+		errs.add(path+".dedup.ttl", "must not be negative")
+	}
+	switch dedup.Store {
+	case "", "memory":
+	case "bbolt":
+		if dedup.Path == "" {
+			errs.add(path+".dedup.path", "required for the bbolt store")
+		}
+	case "redis":
+		if redisEnv.Host == "" {
+			errs.add(path+".dedup.store", "the redis store needs redis settings for environment %s", env)
+		}
+	default:
+		errs.add(path+".dedup.store", "unknown store %q (available: memory, bbolt, redis)", dedup.Store)
+	}
+	return errs
+}
+
+// validateRateLimit checks the consumer's own rate limit and the sinks it names
+func validateRateLimit(consumer ConsumerConfig, path string, sinks map[string]SinkConfig) ValidationErrors {
+	var errs ValidationErrors
+	if limit := consumer.RateLimit; limit != nil {
+		if limit.MessagesPerSecond < 0 || limit.BytesPerSecond < 0 {
+			errs.add(path+".rate_limit", "rates must not be negative")
+		}
+		if limit.MaxInFlight < 0 {
+			errs.add(path+".rate_limit.max_in_flight", "must not be negative")
+		}
+		if adaptive := limit.Adaptive; adaptive != nil {
+			if limit.MessagesPerSecond <= 0 {
+				errs.add(path+".rate_limit.adaptive", "requires messages_per_second, the rate it starts from and returns to")
+			}
+			if adaptive.TargetLatency <= 0 && adaptive.MaxErrorRate <= 0 {
+				errs.add(path+".rate_limit.adaptive", "set target_latency, max_error_rate or both")
+			}
+			if adaptive.TargetLatency < 0 {
+				errs.add(path+".rate_limit.adaptive.target_latency", "must not be negative")
+			}
+			if adaptive.MaxErrorRate < 0 || adaptive.MaxErrorRate > 1 {
+				errs.add(path+".rate_limit.adaptive.max_error_rate", "must be between 0 and 1")
+			}
+			if adaptive.MinMessagesPerSecond < 0 || (limit.MessagesPerSecond > 0 && adaptive.MinMessagesPerSecond > limit.MessagesPerSecond) {
+				errs.add(path+".rate_limit.adaptive.min_messages_per_second", "must be between 0 and messages_per_second")
+			}
+		}
+	}
+	for j, sink := range consumer.Sinks {
+		if _, ok := sinks[sink]; !ok {
+			errs.add(fmt.Sprintf("%s.sinks[%d]", path, j), "unknown sink %q", sink)
+		}
+	}
+	return errs
+}
+
+// validateFailures checks how the consumer handles slow, failing and panicking
+// handlers: timeouts, retries, the dead letter topic and the on_panic policy
+func validateFailures(consumer ConsumerConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	if consumer.HandlerTimeout < 0 {
+		errs.add(path+".handler_timeout", "must not be negative")
+	}
+	if consumer.HandlerWarnAfter < 0 {
+		errs.add(path+".handler_warn_after", "must not be negative")
+	}
+	if consumer.HandlerTimeout > 0 && consumer.HandlerWarnAfter >= consumer.HandlerTimeout {
+		errs.add(path+".handler_warn_after", "must be shorter than handler_timeout")
+	}
+	if consumer.MaxAbandonedHandlers < 0 {
+		errs.add(path+".max_abandoned_handlers", "must not be negative")
+	}
+	if consumer.Retries < 0 {
+		errs.add(path+".retries", "must not be negative")
+	}
+	if consumer.RetryBackoff < 0 {
+		errs.add(path+".retry_backoff", "must not be negative")
+	}
+	if topic := consumer.DeadLetterTopic; topic != "" {
+		for _, consumed := range consumer.StaticTopics() {
+			if consumed == topic {
+				errs.add(path+".dead_letter_topic", "%q is consumed by the consumer itself", topic)
+			}
+		}
+		if pattern, err := compileTopicPattern(consumer.TopicPattern); consumer.TopicPattern != "" && err == nil && pattern.MatchString(topic) {
+			errs.add(path+".dead_letter_topic", "%q matches the consumer's topic_pattern", topic)
+		}
+	}
+	if len(consumer.Handlers) > 0 && (consumer.Retries > 0 || consumer.DeadLetterTopic != "") {
+		errs.add(path+".handlers", "handlers set their own on_failure policy and cannot be combined with retries or dead_letter_topic")
+	}
+	if policy := consumer.OnPanic; policy != nil {
+		if policy.MaxPanics <= 0 {
+			errs.add(path+".on_panic.max_panics", "must be at least 1")
+		}
+		if policy.Window < 0 {
+			errs.add(path+".on_panic.window", "must not be negative")
+		}
+		switch policy.Action {
+		case "", panicStop, panicExit:
+		default:
+			errs.add(path+".on_panic.action", "unknown action %q (available: stop, exit)", policy.Action)
+		}
+	}
+	return errs
+}
+
+// validateLag checks the lag interval and thresholds of a consumer
+func validateLag(lag *LagConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	if lag == nil {
+		return errs
+	}
+	if lag.Interval < 0 || lag.WarningMessages < 0 || lag.CriticalMessages < 0 || lag.WarningTime < 0 || lag.CriticalTime < 0 {
+		errs.add(path+".lag", "interval and thresholds must not be negative")
+	}
+	if lag.WarningMessages > 0 && lag.CriticalMessages > 0 && lag.WarningMessages > lag.CriticalMessages {
+		errs.add(path+".lag.warning_messages", "must not be above critical_messages")
+	}
+	if lag.WarningTime > 0 && lag.CriticalTime > 0 && lag.WarningTime > lag.CriticalTime {
+		errs.add(path+".lag.warning_time", "must not be above critical_time")
+	}
+	return errs
+}
+
+// validateCircuitBreaker checks the thresholds of a consumer or sink circuit breaker
+func validateCircuitBreaker(breaker CircuitBreakerConfig, path string) ValidationErrors {
+	var errs ValidationErrors
+	if breaker.ConsecutiveFailures <= 0 && breaker.FailureRate <= 0 {
+		errs.add(path, "set consecutive_failures, failure_rate or both")
+	}
+	if breaker.ConsecutiveFailures < 0 {
+		errs.add(path+".consecutive_failures", "must not be negative")
+	}
+	if breaker.FailureRate < 0 || breaker.FailureRate > 1 {
+		errs.add(path+".failure_rate", "must be between 0 and 1")
+	}
+	if breaker.Window < 0 {
+		errs.add(path+".window", "must not be negative")
+	}
+	if breaker.Cooldown < 0 {
+		errs.add(path+".cooldown", "must not be negative")
+	}
+	return errs
+}
+
+// consumerNamePattern restricts consumer names to characters that are safe in
+// log prefixes, metric labels and MULTICONSUMER_* environment variable names
+var consumerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// handlerNames lists the registered handler names
+func handlerNames() []string {
+	return sortedKeys(handlerRegistry)
+}
+
+// validateCommand implements "validate": it loads and checks the configuration
+// without starting any consumer
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags := addConfigFlags(fs)
+	fs.Parse(args)
+
+	config, err := loadConfig(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	if errs := ValidateConfig(config, *flags.env); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Configuration has %d problem(s) for environment %s:\n%v\n", len(errs), *flags.env, errs)
+		return 1
+	}
+	fmt.Printf("Configuration is valid for environment %s\n", *flags.env)
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const validateTestConfig = `{
+	"environments": {"production": {}, "staging": {"extends": "production"}},
+	"redis": {"production": {"host": "redis.internal", "port": 6379}},
+	"kafka": {"production": {"brokers": ["kafka-1:9092"]}},
+	"kafkaConsumers": [
+		{"name": "cities", "topic": "cities", "group_id": "cities-group", "log_file": "cities.log", "handler_name": "handler2"}
+	]
+}`
+
+// validateWith decodes the test config with patch merged over it, as a later
+// config file would be
+func validateWith(t *testing.T, patch string) ValidationErrors {
+	t.Helper()
+	var trees []map[string]interface{}
+	for _, data := range []string{validateTestConfig, patch} {
+		var tree map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &tree); err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, tree)
+	}
+	data, err := json.Marshal(mergeConfigFiles(trees))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config FullConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	return ValidateConfig(&config, "staging")
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  []string
+	}{
+		{name: "valid", patch: `{}`},
+		{
+			name:  "unknown handler",
+			patch: `{"kafkaConsumers": [{"name": "cities", "handler_name": "handler9"}]}`,
+			want:  []string{`kafkaConsumers[0].handler_name: unknown handler "handler9" (available: handler1, handler2, passthrough)`},
+		},
+		{
+			name:  "bad settings",
+			patch: `{"kafkaConsumers": [{"name": "cities", "handler_name": "handler1", "settings": {"mappings": "code", "lab_codes": {"rules": [{"name": "x"}]}, "extra": 1}}]}`,
+			want: []string{
+				"kafkaConsumers[0].settings.extra: unknown setting",
+				"kafkaConsumers[0].settings.lab_codes.rules[0].action: required setting is missing",
+				"kafkaConsumers[0].settings.mappings: expected an object, got string",
+			},
+		},
+		{
+			name:  "unknown extends",
+			patch: `{"environments": {"qa": {"extends": "testing"}, "dev": {"extends": "local"}}}`,
+			want: []string{
+				`environments.dev.extends: unknown environment "local"`,
+				`environments.qa.extends: unknown environment "testing"`,
+			},
+		},
+		{
+			name:  "circular extends",
+			patch: `{"environments": {"production": {"extends": "staging"}}}`,
+			want: []string{
+				"environments: environment staging: circular extends via staging",
+				"kafkaConsumers[0].brokers: no brokers configured for the consumer or for environment staging",
+			},
+		},
+		{
+			name:  "handlers with retries",
+			patch: `{"kafkaConsumers": [{"name": "cities", "handler_name": "", "handlers": [{"handler_name": "handler2"}], "retries": 3}]}`,
+			want:  []string{"kafkaConsumers[0].handlers: handlers set their own on_failure policy and cannot be combined with retries or dead_letter_topic"},
+		},
+		{
+			name:  "bad topic pattern",
+			patch: `{"kafkaConsumers": [{"name": "cities", "topic": "", "topic_pattern": "cities-(["}]}`,
+			want:  []string{"kafkaConsumers[0].topic_pattern: invalid regular expression: error parsing regexp: missing closing ]: `[)$`"},
+		},
+		{
+			name:  "dead letter topic is consumed",
+			patch: `{"kafkaConsumers": [{"name": "cities", "dead_letter_topic": "cities"}]}`,
+			want:  []string{`kafkaConsumers[0].dead_letter_topic: "cities" is consumed by the consumer itself`},
+		},
+		{
+			name:  "missing fields",
+			patch: `{"kafkaConsumers": [{"name": "cities", "group_id": "", "log_file": "", "topic": "", "handler_name": ""}]}`,
+			want: []string{
+				"kafkaConsumers[0].group_id: required field is missing",
+				"kafkaConsumers[0].log_file: required field is missing",
+				"kafkaConsumers[0].topic: one of topic, topics or topic_pattern is required",
+				"kafkaConsumers[0].handler_name: required field is missing",
+			},
+		},
+		{
+			name:  "duplicate consumer",
+			patch: `{"kafkaConsumers": [{"name": "towns", "topic": "cities", "group_id": "cities-group", "log_file": "towns.log", "handler_name": "handler2"}]}`,
+			want:  []string{`kafkaConsumers[1]: group_id "cities-group" and topic "cities" are already used by kafkaConsumers[0]`},
+		},
+		{
+			name:  "negative start offsets",
+			patch: `{"kafkaConsumers": [{"name": "cities", "start_offset": {"cities": {"2": -1, "0": -5}}}]}`,
+			want: []string{
+				"kafkaConsumers[0].start_offset.cities.0: partitions and offsets must not be negative",
+				"kafkaConsumers[0].start_offset.cities.2: partitions and offsets must not be negative",
+			},
+		},
+		{
+			name:  "kafka settings",
+			patch: `{"kafkaConsumers": [{"name": "cities", "brokers": ["kafka-1"], "heartbeat_interval": "10s", "session_timeout": "5s", "commit_strategy": "later"}]}`,
+			want: []string{
+				`kafkaConsumers[0].brokers[0]: invalid broker address "kafka-1": address kafka-1: missing port in address`,
+				"kafkaConsumers[0].heartbeat_interval: must be shorter than session_timeout",
+				`kafkaConsumers[0].commit_strategy: unknown commit strategy "later" (available: sync, interval, manual)`,
+			},
+		},
+		{
+			name:  "circuit breakers",
+			patch: `{"sinks": {"db": {"circuit_breaker": {}}}, "kafkaConsumers": [{"name": "cities", "sinks": ["db", "cache"], "circuit_breaker": {"failure_rate": 2}}]}`,
+			want: []string{
+				"sinks.db.circuit_breaker: set consecutive_failures, failure_rate or both",
+				`kafkaConsumers[0].sinks[1]: unknown sink "cache"`,
+				"kafkaConsumers[0].circuit_breaker.failure_rate: must be between 0 and 1",
+			},
+		},
+		{
+			name:  "forward on other brokers",
+			patch: `{"kafkaConsumers": [{"name": "cities", "handler_name": "passthrough", "brokers": ["kafka-9:9092"], "forward": {"topic": "cities_copy"}}]}`,
+			want:  []string{"kafkaConsumers[0].forward: the forward topic is written to the environment's brokers, so the consumer cannot override brokers or security"},
+		},
+		{
+			name:  "forward with the environment's brokers",
+			patch: `{"kafkaConsumers": [{"name": "cities", "handler_name": "passthrough", "brokers": ["kafka-1:9092"], "forward": {"topic": "cities_copy"}}]}`,
+		},
+		{
+			name:  "dead letters on other brokers",
+			patch: `{"kafkaConsumers": [{"name": "cities", "security": {"tls": {"enabled": true}}, "dead_letter_topic": "cities_dead_letters"}]}`,
+			want:  []string{"kafkaConsumers[0].dead_letter_topic: the dead letter topic is written to the environment's brokers, so the consumer cannot override brokers or security"},
+		},
+		{
+			name:  "lag thresholds",
+			patch: `{"kafkaConsumers": [{"name": "cities", "lag": {"warning_messages": 100, "critical_messages": 10}}]}`,
+			want:  []string{"kafkaConsumers[0].lag.warning_messages: must not be above critical_messages"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range validateWith(t, tt.patch) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errors:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// maxStackDump caps the goroutine stacks logged for a slow handler
+const maxStackDump = 1 << 20
+
+const defaultMaxAbandonedHandlers = 10
+
+var (
+	handlerTimeoutsTotal = metrics.counter("multiconsumer_handler_timeouts_total", "Handler calls that ran past handler_timeout.", "consumer")
+	slowHandlersTotal    = metrics.counter("multiconsumer_slow_handlers_total", "Handler calls that ran past handler_warn_after.", "consumer")
+	abandonedHandlers    = metrics.gauge("multiconsumer_abandoned_handlers", "Handler calls abandoned at handler_timeout that are still running.", "consumer")
+)
+
+// ErrHandlerTimeout is returned for a handler call that ran past the
+// consumer's handler_timeout. It counts as a failure like any handler error.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// callHandler makes one handler call for message with the consumer's handler
+// timeout, watchdog and panic recovery
+func (kc *KafkaConsumer) callHandler(ctx context.Context, message kafka.Message) error {
+	return runHandler(ctx, kc.consumerConfig, kc.handleMessage, message, kc.logger, kc.abandoned)
+}
+
+// abandonedCalls counts the handler calls abandoned at their timeout that are
+// still running. Each holds a goroutine, and whatever the handler holds, until
+// it returns, so a consumer stops taking messages at the limit.
+type abandonedCalls struct {
+	consumer string
+	limit    int
+
+	mu     sync.Mutex
+	count  int
+	freed  chan struct{}
+	paused bool
+}
+
+func newAbandonedCalls(config ConsumerConfig) *abandonedCalls {
+	limit := config.MaxAbandonedHandlers
+	if limit <= 0 {
+		limit = defaultMaxAbandonedHandlers
+	}
+	abandonedHandlers.Set(0, config.Name)
+	a := &abandonedCalls{consumer: config.Name, limit: limit, freed: make(chan struct{})}
+	health.register("abandoned_handlers", config.Name, a.health)
+	return a
+}
+
+// health reports the consumer as degraded while it is paused at the limit
+func (a *abandonedCalls) health() healthStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := healthStatus{Status: healthOK, Details: map[string]interface{}{"running": a.count, "limit": a.limit}}
+	if a.count >= a.limit {
+		status.Status = healthDegraded
+	}
+	return status
+}
+
+// wait blocks while the limit of abandoned calls is reached. It reports false
+// when ctx ends first.
+func (a *abandonedCalls) wait(ctx context.Context, logger func(level string, msg string, args ...interface{})) bool {
+	for {
+		a.mu.Lock()
+		if a.count < a.limit {
+			if a.paused {
+				a.paused = false
+				logger("INFO", "Abandoned handler calls are below max_abandoned_handlers again; resuming")
+			}
+			a.mu.Unlock()
+			return true
+		}
+		if !a.paused {
+			a.paused = true
+			logger("ERROR", "%d abandoned handler calls are still running, reaching max_abandoned_handlers; pausing until one returns", a.count)
+		}
+		freed := a.freed
+		a.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-freed:
+		}
+	}
+}
+
+// abandon counts a call given up at its timeout until result receives its outcome
+func (a *abandonedCalls) abandon(result <-chan error) {
+	a.mu.Lock()
+	a.count++
+	abandonedHandlers.Set(float64(a.count), a.consumer)
+	a.mu.Unlock()
+
+	go func() {
+		<-result
+		a.mu.Lock()
+		a.count--
+		abandonedHandlers.Set(float64(a.count), a.consumer)
+		close(a.freed)
+		a.freed = make(chan struct{})
+		a.mu.Unlock()
+	}()
+}
+
+// runHandler makes one handler call for message. The handler's ctx keeps the
+// values of ctx but is not cancelled with it, so that a rebalance or shutdown
+// lets the current message finish; its deadline is the handler_timeout. A
+// handler still running at the deadline is abandoned and the call fails. Past
+// handler_warn_after, a watchdog logs the call and, once per stall, the stacks
+// of all goroutines. A panic of the handler is recovered and returned as
+// ErrHandlerPanic. Abandoned calls are counted in abandoned until they return.
+// A timeout of a handlers list with a blocking handler wraps ErrCommitBlocked.
+func runHandler(ctx context.Context, config ConsumerConfig, handle func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error, message kafka.Message, logger func(level string, msg string, args ...interface{}), abandoned *abandonedCalls) error {
+	ctx = context.WithoutCancel(ctx)
+	name := config.Name
+
+	if warnAfter := time.Duration(config.HandlerWarnAfter); warnAfter > 0 {
+		fired := make(chan struct{})
+		watchdog := time.AfterFunc(warnAfter, func() {
+			defer close(fired)
+			slowHandlersTotal.Inc(name)
+			if stalls.begin() {
+				logger("WARNING", "Handler still running after %s for message %s. Goroutine stacks:\n%s", warnAfter, describeMessage(message), goroutineStacks())
+			} else {
+				logger("WARNING", "Handler still running after %s for message %s; goroutine stacks were logged when the stall began", warnAfter, describeMessage(message))
+			}
+		})
+		defer func() {
+			if !watchdog.Stop() {
+				<-fired
+				stalls.end()
+			}
+		}()
+	}
+
+	call := func(ctx context.Context) (err error) {
+		defer recoverHandlerPanic(&err, message, logger)
+		return handle(ctx, message, config, logger)
+	}
+	timeout := time.Duration(config.HandlerTimeout)
+	if timeout <= 0 {
+		return call(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- call(ctx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger("WARNING", "Handler did not return within %s for message %s; abandoning the call", timeout, describeMessage(message))
+		abandoned.abandon(result)
+	}
+	if err != nil && !errors.Is(err, ErrSkipMessage) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		handlerTimeoutsTotal.Inc(name)
+		err = fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, timeout, err)
+		if hasBlockingHandler(config) && !errors.Is(err, ErrCommitBlocked) {
+			return fmt.Errorf("%w: %w", ErrCommitBlocked, err)
+		}
+	}
+	return err
+}
+
+// stallTracker counts the handler calls running past handler_warn_after. A
+// stall lasts while any such call runs. Goroutine stacks cover the whole
+// process, so they are dumped once per stall rather than for every slow call.
+type stallTracker struct {
+	mu   sync.Mutex
+	slow int
+}
+
+var stalls = &stallTracker{}
+
+// begin counts a slow call and reports whether it starts a stall
+func (s *stallTracker) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slow++
+	return s.slow == 1
+}
+
+// end counts a slow call as returned
+func (s *stallTracker) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slow--
+}
+
+// goroutineStacks returns the stacks of all goroutines, truncated to maxStackDump bytes
+func goroutineStacks() []byte {
+	buf := make([]byte, maxStackDump)
+	return buf[:runtime.Stack(buf, true)]
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// logRecorder keeps the messages logged through its log method
+type logRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) log(level string, msg string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, level+": "+fmt.Sprintf(msg, args...))
+}
+
+// count returns how many logged messages contain text
+func (r *logRecorder) count(text string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, message := range r.messages {
+		if strings.Contains(message, text) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRunHandler(t *testing.T) {
+	failure := errors.New("downstream unavailable")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		handle  func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error
+		want    []error
+	}{
+		{
+			name: "success",
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				return nil
+			},
+		},
+		{
+			name: "failure",
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				return failure
+			},
+			want: []error{failure},
+		},
+		{
+			name: "panic",
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				panic("boom")
+			},
+			want: []error{ErrHandlerPanic},
+		},
+		{
+			name:    "skip within the timeout",
+			timeout: time.Second,
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				return ErrSkipMessage
+			},
+			want: []error{ErrSkipMessage},
+		},
+		{
+			name:    "timeout honoured by the handler",
+			timeout: 10 * time.Millisecond,
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			want: []error{ErrHandlerTimeout, context.DeadlineExceeded},
+		},
+		{
+			name:    "panic within the timeout",
+			timeout: time.Second,
+			handle: func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+				panic("boom")
+			},
+			want: []error{ErrHandlerPanic},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := ConsumerConfig{Name: "test-run", HandlerTimeout: Duration(tt.timeout)}
+			err := runHandler(context.Background(), config, tt.handle, kafka.Message{Topic: "cities"}, discardLog, newAbandonedCalls(config))
+			if tt.want == nil && err != nil {
+				t.Fatalf("error = %v, want nil", err)
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("error = %v, want %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunHandlerIgnoresCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handle := func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+		return ctx.Err()
+	}
+	config := ConsumerConfig{Name: "test-cancel", HandlerTimeout: Duration(time.Second)}
+	if err := runHandler(ctx, config, handle, kafka.Message{}, discardLog, newAbandonedCalls(config)); err != nil {
+		t.Errorf("error = %v, want the handler to run despite the cancelled context", err)
+	}
+}
+
+func TestRunHandlerAbandonsAndPauses(t *testing.T) {
+	config := ConsumerConfig{Name: "test-abandon", HandlerTimeout: Duration(10 * time.Millisecond), MaxAbandonedHandlers: 2}
+	abandoned := newAbandonedCalls(config)
+	release := make(chan struct{})
+	stuck := func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+		<-release
+		return nil
+	}
+	running := func() int {
+		abandoned.mu.Lock()
+		defer abandoned.mu.Unlock()
+		return abandoned.count
+	}
+
+	for i := 1; i <= 2; i++ {
+		if !abandoned.wait(context.Background(), discardLog) {
+			t.Fatalf("call %d: wait returned false below the limit", i)
+		}
+		err := runHandler(context.Background(), config, stuck, kafka.Message{Offset: int64(i)}, discardLog, abandoned)
+		if !errors.Is(err, ErrHandlerTimeout) {
+			t.Fatalf("call %d: error = %v, want ErrHandlerTimeout", i, err)
+		}
+		if running() != i {
+			t.Fatalf("call %d: %d abandoned calls, want %d", i, running(), i)
+		}
+	}
+	if status := abandoned.health(); status.Status != healthDegraded {
+		t.Errorf("health at the limit = %s, want %s", status.Status, healthDegraded)
+	}
+
+	logs := &logRecorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if abandoned.wait(ctx, logs.log) {
+		t.Fatal("wait returned true at max_abandoned_handlers")
+	}
+	if logs.count("pausing") != 1 {
+		t.Errorf("pause logged %d times, want once", logs.count("pausing"))
+	}
+
+	resumed := make(chan bool)
+	go func() { resumed <- abandoned.wait(context.Background(), logs.log) }()
+	close(release)
+	select {
+	case ok := <-resumed:
+		if !ok {
+			t.Fatal("wait returned false after the abandoned calls returned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not resume after the abandoned calls returned")
+	}
+	if logs.count("resuming") != 1 {
+		t.Errorf("resume logged %d times, want once", logs.count("resuming"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for running() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if running() != 0 {
+		t.Errorf("%d abandoned calls after they returned, want 0", running())
+	}
+}
+
+func TestWatchdogDumpsStacksOncePerStall(t *testing.T) {
+	config := ConsumerConfig{Name: "test-watchdog", HandlerWarnAfter: Duration(10 * time.Millisecond)}
+	logs := &logRecorder{}
+
+	stall := func(calls int) {
+		release := make(chan struct{})
+		started := make(chan struct{}, calls)
+		handle := func(ctx context.Context, message kafka.Message, config ConsumerConfig, logFunc func(level string, msg string, args ...interface{})) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}
+		warned := logs.count("Handler still running")
+		var wg sync.WaitGroup
+		for i := 0; i < calls; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				runHandler(context.Background(), config, handle, kafka.Message{Offset: int64(i)}, logs.log, newAbandonedCalls(config))
+			}(i)
+		}
+		for i := 0; i < calls; i++ {
+			<-started
+		}
+		deadline := time.Now().Add(time.Second)
+		for logs.count("Handler still running") < warned+calls && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+	}
+
+	stall(3)
+	if got := logs.count("Handler still running"); got != 3 {
+		t.Fatalf("%d slow call warnings, want 3", got)
+	}
+	if got := logs.count("Goroutine stacks:"); got != 1 {
+		t.Errorf("%d stack dumps in the first stall, want 1", got)
+	}
+
+	stall(1)
+	if got := logs.count("Goroutine stacks:"); got != 2 {
+		t.Errorf("%d stack dumps after the second stall, want 2", got)
+	}
+}